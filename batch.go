@@ -0,0 +1,37 @@
+package kv
+
+import (
+	"kv/internal/memtable"
+)
+
+/*
+WriteBatch collects puts and deletes that DB.Write applies as one atomic unit: readers
+either observe all of them or none. Later entries for the same key win over earlier ones.
+A WriteBatch is not safe for concurrent use.
+*/
+type WriteBatch struct {
+	kvs []memtable.KV
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put a copy of val, the caller may reuse val once Put returns.
+func (batch *WriteBatch) Put(key string, val []byte) {
+	// a nil val marks a deletion in the memtable, the copy is never nil
+	batch.kvs = append(batch.kvs, memtable.KV{Key: key, Val: append([]byte{}, val...)})
+}
+
+func (batch *WriteBatch) Delete(key string) {
+	batch.kvs = append(batch.kvs, memtable.KV{Key: key})
+}
+
+func (batch *WriteBatch) Clear() {
+	batch.kvs = batch.kvs[:0]
+}
+
+// the number of puts and deletes in the batch
+func (batch *WriteBatch) Len() int {
+	return len(batch.kvs)
+}
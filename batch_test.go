@@ -0,0 +1,62 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put("a", []byte("1"))
+	batch.Put("b", nil)
+	batch.Delete("c")
+	assert.Equal(t, 3, batch.Len())
+	batch.Clear()
+	assert.Zero(t, batch.Len())
+}
+
+func TestDBWrite(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	assert.NoError(t, db.Put("deleted", []byte("val"), nil))
+
+	batch := NewWriteBatch()
+	batch.Put("a", []byte("1"))
+	batch.Put("b", []byte("2"))
+	batch.Put("a", []byte("3"))
+	batch.Delete("deleted")
+	batch.Put("empty", nil)
+	assert.NoError(t, db.Write(batch, &WriteOptions{Sync: true}))
+
+	for key, expected := range map[string]string{"a": "3", "b": "2", "empty": ""} {
+		val, err := db.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(val))
+	}
+	_, err := db.Get("deleted", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, db.Write(NewWriteBatch(), nil))
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Write(batch, nil), ErrClosed)
+}
+
+func TestWriteBatchCopiesVals(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	buf := []byte("hello")
+	assert.NoError(t, db.Put("put", buf, nil))
+	batch := NewWriteBatch()
+	batch.Put("batch", buf)
+	buf[0] = 'J'
+	assert.NoError(t, db.Write(batch, nil))
+	buf[0] = 'Y'
+
+	for _, key := range []string{"put", "batch"} {
+		val, err := db.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(val), key)
+	}
+}
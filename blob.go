@@ -0,0 +1,98 @@
+package kv
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"kv/internal/memtable"
+)
+
+/*
+Blobs are values stored under the hex SHA-256 of their content, so identical blobs are
+stored once however often they are put: the content key is written once, a put finding it
+taken only counts another reference. Every delete drops a reference, the blob is deleted
+with its last one. The content lives under blobPrefix and the reference count under
+blobRefsPrefix, followed by the hash, both out of reach of users in the reserved keys.
+Blobs are stored inline like any other value.
+*/
+
+const (
+	blobPrefix     = reservedPrefix + "blob/"
+	blobRefsPrefix = reservedPrefix + "blobrefs/"
+)
+
+// Store data as a blob, or take another reference to it if it is stored already. Returns the
+// hash to get it by.
+func (db *DB) PutBlob(data []byte, wo *WriteOptions) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return "", ErrClosed
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	refs, err := db.blobRefs(hash)
+	if err != nil {
+		return "", err
+	}
+	kvs := []memtable.KV{{Key: blobRefsPrefix + hash, Val: binary.LittleEndian.AppendUint64(nil, refs+1)}}
+	// a nil val marks a deletion in the memtable, the copy is never nil
+	content := []memtable.KV{{Key: blobPrefix + hash, Val: append([]byte{}, data...)}}
+	switch err := db.checkWriteOnce(content); {
+	case err == nil:
+		kvs = append(kvs, content...)
+	case !errors.Is(err, ErrKeyExists):
+		return "", err
+	}
+	return hash, db.apply(kvs, wo)
+}
+
+func (db *DB) GetBlob(hash string, ro *ReadOptions) ([]byte, error) {
+	return db.get(blobPrefix+hash, ro)
+}
+
+// Drop a reference to the blob, the blob is deleted once none is left.
+func (db *DB) DeleteBlob(hash string, wo *WriteOptions) error {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	refs, err := db.blobRefs(hash)
+	if err != nil {
+		return err
+	}
+	switch refs {
+	case 0:
+		return ErrNotFound
+	case 1:
+		return db.apply([]memtable.KV{{Key: blobRefsPrefix + hash}, {Key: blobPrefix + hash}}, wo)
+	default:
+		return db.apply([]memtable.KV{{Key: blobRefsPrefix + hash, Val: binary.LittleEndian.AppendUint64(nil, refs-1)}}, wo)
+	}
+}
+
+// the reference count of the blob, zero if it is not stored. The caller must hold writeMutex.
+func (db *DB) blobRefs(hash string) (uint64, error) {
+	val, found, err := db.lookup(blobRefsPrefix+hash, nil)
+	if err != nil || !found {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("%w: reference count of blob %s", ErrCorrupt, hash)
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
@@ -0,0 +1,130 @@
+package kv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobs(t *testing.T) {
+	path := t.TempDir()
+	// blobs dedup under WriteOnce as well
+	opts := &Options{WriteOnce: true}
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+
+	hash, err := db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	assert.Len(t, hash, 64)
+	again, err := db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, again)
+	other, err := db.PutBlob([]byte("other"), nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	// the blob outlives all but its last reference
+	for i := 0; i < 2; i++ {
+		data, err := db.GetBlob(hash, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "content", string(data))
+		assert.NoError(t, db.DeleteBlob(hash, nil))
+	}
+	_, err = db.GetBlob(hash, nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, db.DeleteBlob(hash, nil), ErrNotFound)
+	data, err := db.GetBlob(other, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", string(data))
+
+	// a deleted blob can be stored again
+	_, err = db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	data, err = db.GetBlob(hash, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	_, err = db.PutBlob(nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestBlobsDedupWithoutWriteOnce(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	hash, err := db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	_, err = db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.DeleteBlob(hash, nil))
+	data, err := db.GetBlob(hash, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
+
+func TestBlobsReserved(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	hash, err := db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+
+	key := blobPrefix + hash
+	assert.ErrorIs(t, db.Put(key, []byte("other"), nil), ErrReservedKey)
+	assert.ErrorIs(t, db.Delete(blobRefsPrefix+hash, nil), ErrReservedKey)
+	assert.ErrorIs(t, db.DeleteRange("", "z", nil), ErrReservedKey)
+	assert.ErrorIs(t, db.DeletePrefix("\x00", nil), ErrReservedKey)
+	_, err = db.Get(key, nil)
+	assert.ErrorIs(t, err, ErrReservedKey)
+	_, err = db.Has(key, nil)
+	assert.ErrorIs(t, err, ErrReservedKey)
+	_, errs := db.MultiGet([]string{key}, nil)
+	assert.ErrorIs(t, errs[0], ErrReservedKey)
+
+	// ranges and prefixes beside the reserved keys are fine
+	assert.NoError(t, db.DeleteRange("\x00", "\x00kv", nil))
+	assert.NoError(t, db.DeleteRange("a", "z", nil))
+	assert.NoError(t, db.DeletePrefix("blob/", nil))
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	w, err := NewTableWriter(external, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Delete(key))
+	assert.NoError(t, w.Finish())
+	assert.ErrorIs(t, db.IngestSSTable(external), ErrReservedKey)
+
+	data, err := db.GetBlob(hash, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
+
+func TestBlobsSkipCompactionFilter(t *testing.T) {
+	opts := &Options{
+		MemtableThreshold:   512,
+		L0CompactionTrigger: 2,
+		// a filter expiring everything it is shown
+		CompactionFilter: func(key string, val []byte) []byte {
+			return nil
+		},
+	}
+	db, err := Open(t.TempDir(), opts)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	hash, err := db.PutBlob([]byte("content"), nil)
+	assert.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), make([]byte, 20), nil))
+	}
+	waitForJobs(t, db)
+	_, err = db.Get("key-000", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	data, err := db.GetBlob(hash, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
@@ -0,0 +1,163 @@
+package kv
+
+import (
+	"kv/internal/compaction"
+	"kv/internal/sstable"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+/*
+Compactions run as background jobs, see jobs.go. The merge runs without any lock held, only
+applying its outcome takes versionMutex, so flushes and other compactions go on meanwhile.
+*/
+
+type compactionTask struct {
+	*compaction.Task
+	// the tables of Upper and Lower, in order
+	inputs []*table
+}
+
+// Pick the next compaction among the tables not being compacted. The caller must hold jobsMutex.
+func (db *DB) pickCompaction() *compactionTask {
+	db.versionMutex.Lock()
+	defer db.versionMutex.Unlock()
+
+	levels := make([][]compaction.Table, len(db.levels))
+	tables := map[uint64]*table{}
+	for i, level := range db.levels {
+		for _, t := range level {
+			levels[i] = append(levels[i], t.meta)
+			tables[t.meta.Num] = t
+		}
+	}
+	task := db.picker.Pick(levels, db.compacting)
+	if task == nil {
+		return nil
+	}
+	inputs := []*table{}
+	for _, t := range append(task.Upper, task.Lower...) {
+		inputs = append(inputs, tables[t.Num])
+	}
+	return &compactionTask{Task: task, inputs: inputs}
+}
+
+/*
+Merge the inputs of the task into new tables and replace them with these. Only the
+compaction holding a table drops it, so the inputs stay open till it is done.
+*/
+func (db *DB) compact(task *compactionTask) error {
+	readers := []*sstable.Reader{}
+	removed := map[uint64]bool{}
+	for _, t := range task.inputs {
+		readers = append(readers, t.reader)
+		removed[t.meta.Num] = true
+	}
+	tableDir := filepath.Join(db.path, db.opts.TableSubdir)
+	// a size-tiered compaction writes a single table
+	targetSize := db.opts.TargetTableSize
+	if task.Output == 0 {
+		targetSize = math.MaxUint64
+	}
+	nums := []uint64{}
+	opts := compaction.MergeOptions{
+		TargetSize:     targetSize,
+		Filter:         db.compactionFilter(),
+		Limiter:        db.compactionLimiter,
+		DropTombstones: task.Bottom,
+	}
+	tableOpts := db.opts.tableOptions()
+	tableOpts.Limiter = db.compactionLimiter
+	err := compaction.Merge(readers, opts, func() (*sstable.Writer, error) {
+		num := db.newTableNum()
+		nums = append(nums, num)
+		return sstable.NewWriter(filepath.Join(tableDir, tableName(num)), tableOpts)
+	})
+	outputs := []*table{}
+	for i := 0; err == nil && i < len(nums); i++ {
+		var t *table
+		if t, err = openTable(tableDir, nums[i]); err == nil {
+			outputs = append(outputs, t)
+		}
+	}
+	if err == nil {
+		err = db.applyEdit(versionEdit{removed: removed, level: task.Output, added: outputs})
+	}
+	if err != nil {
+		for _, t := range outputs {
+			t.reader.Close()
+		}
+		for _, num := range nums {
+			os.Remove(filepath.Join(tableDir, tableName(num)))
+		}
+		return corruptErr(err)
+	}
+	return nil
+}
+
+/*
+Compact till no level is beyond its target. Under DeterministicCompaction this runs after
+every table added to L0, one compaction at a time, so the tables are a function of the
+writes alone, not of when background jobs happen to run. The caller must hold flushMutex.
+*/
+func (db *DB) compactAll() error {
+	for {
+		db.jobsMutex.Lock()
+		task := db.pickCompaction()
+		db.jobsMutex.Unlock()
+		if task == nil {
+			return nil
+		}
+		if err := db.compact(task); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Take the tables lying within [start, end) away from compaction, so that they can be dropped.
+Tables being compacted are left alone. releaseTables hands them back.
+*/
+func (db *DB) reserveTables(start, end string) map[uint64]bool {
+	db.jobsMutex.Lock()
+	defer db.jobsMutex.Unlock()
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+
+	reserved := map[uint64]bool{}
+	for _, level := range db.levels {
+		for _, t := range level {
+			// Largest may be the exclusive end of a range tombstone, so end itself is excluded
+			if start <= t.meta.Smallest && t.meta.Largest < end && !db.compacting[t.meta.Num] {
+				reserved[t.meta.Num] = true
+				db.compacting[t.meta.Num] = true
+			}
+		}
+	}
+	return reserved
+}
+
+func (db *DB) releaseTables(reserved map[uint64]bool) {
+	db.jobsMutex.Lock()
+	defer db.jobsMutex.Unlock()
+
+	for num := range reserved {
+		delete(db.compacting, num)
+	}
+	db.scheduleJobsLocked()
+}
+
+// the CompactionFilter of the options, leaving the reserved keys alone
+func (db *DB) compactionFilter() func(key string, val []byte) []byte {
+	filter := db.opts.CompactionFilter
+	if filter == nil {
+		return nil
+	}
+	return func(key string, val []byte) []byte {
+		if reservedKey(key) {
+			return val
+		}
+		return filter(key, val)
+	}
+}
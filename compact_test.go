@@ -0,0 +1,235 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+Overwrite and delete keys over many flushes, wait for compaction to drain L0 and check that
+nothing is lost, before and after reopening. checkLevels checks the levels at last.
+*/
+func testCompaction(t *testing.T, opts *Options, checkLevels func([]TableProperties)) {
+	path := t.TempDir()
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+	expected := map[string]string{}
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("key-%03d", i%300)
+		val := fmt.Sprintf("val-%d-%s", i, make([]byte, 20))
+		assert.NoError(t, db.Put(key, []byte(val), nil))
+		expected[key] = val
+		if i%50 == 49 {
+			del := fmt.Sprintf("key-%03d", (i*7)%300)
+			assert.NoError(t, db.Delete(del, nil))
+			delete(expected, del)
+		}
+	}
+	assert.NoError(t, db.DeleteRange("key-100", "key-120", nil))
+	for i := 100; i < 120; i++ {
+		delete(expected, fmt.Sprintf("key-%03d", i))
+	}
+	assert.NoError(t, db.Put("key-110", []byte("back"), nil))
+	expected["key-110"] = "back"
+
+	// wait for L0 to drain into the levels below
+	assert.Eventually(t, func() bool {
+		props, err := db.TableProperties()
+		assert.NoError(t, err)
+		l0 := 0
+		for _, p := range props {
+			if p.Level == 0 {
+				l0++
+			}
+		}
+		return l0 < opts.L0CompactionTrigger
+	}, 5*time.Second, 10*time.Millisecond)
+
+	check := func(db *DB) {
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			val, err := db.Get(key, nil)
+			if want, ok := expected[key]; ok {
+				assert.NoError(t, err, key)
+				assert.Equal(t, want, string(val), key)
+			} else {
+				assert.ErrorIs(t, err, ErrNotFound, key)
+			}
+		}
+		props, err := db.TableProperties()
+		assert.NoError(t, err)
+		checkLevels(props)
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestCompaction(t *testing.T) {
+	// with a single job flushes and compactions take turns, with more they run side by side
+	for _, c := range []struct {
+		jobs      int
+		rateLimit int64
+	}{{1, 0}, {4, 0}, {2, 1024 * 1024}} {
+		opts := &Options{
+			MemtableThreshold:   512,
+			L0CompactionTrigger: 2,
+			BaseLevelSize:       8 * 1024,
+			LevelSizeMultiplier: 2,
+			TargetTableSize:     2 * 1024,
+			NumLevels:           4,
+			MaxBackgroundJobs:   c.jobs,
+			CompactionRateLimit: c.rateLimit,
+		}
+		testCompaction(t, opts, func(props []TableProperties) {
+			levels := map[int]int{}
+			for i, p := range props {
+				levels[p.Level]++
+				// the tables of a level below L0 are disjoint and in key order
+				if i > 0 && p.Level > 0 && props[i-1].Level == p.Level {
+					assert.Greater(t, p.MinKey, props[i-1].MaxKey)
+				}
+			}
+			assert.Greater(t, levels[1]+levels[2]+levels[3], 1)
+		})
+	}
+}
+
+func TestCompactionSizeTiered(t *testing.T) {
+	opts := &Options{MemtableThreshold: 512, CompactionStyle: CompactionSizeTiered, L0CompactionTrigger: 4}
+	testCompaction(t, opts, func(props []TableProperties) {
+		assert.Less(t, len(props), 4)
+		for _, p := range props {
+			assert.Zero(t, p.Level)
+		}
+	})
+}
+
+func TestCompactionFilter(t *testing.T) {
+	var mutex sync.Mutex
+	filtered := map[string]bool{}
+	opts := &Options{
+		MemtableThreshold:   512,
+		L0CompactionTrigger: 2,
+		MaxBackgroundJobs:   4,
+		// expire the odd keys and rewrite the even ones
+		CompactionFilter: func(key string, val []byte) []byte {
+			mutex.Lock()
+			defer mutex.Unlock()
+			filtered[key] = true
+			if key[len(key)-1]%2 == 1 {
+				return nil
+			}
+			return []byte("rewritten")
+		},
+	}
+	db, err := Open(t.TempDir(), opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), make([]byte, 20), nil))
+	}
+	waitForJobs(t, db)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.NotEmpty(t, filtered)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		val, err := db.Get(key, nil)
+		switch {
+		case !filtered[key]:
+			assert.Equal(t, make([]byte, 20), val, key)
+		case i%2 == 1:
+			assert.ErrorIs(t, err, ErrNotFound, key)
+		default:
+			assert.Equal(t, "rewritten", string(val), key)
+		}
+	}
+}
+
+func TestDeterministicCompaction(t *testing.T) {
+	opts := &Options{
+		MemtableThreshold:       512,
+		L0CompactionTrigger:     2,
+		BaseLevelSize:           4 * 1024,
+		LevelSizeMultiplier:     2,
+		TargetTableSize:         1024,
+		NumLevels:               4,
+		MaxBackgroundJobs:       4,
+		DeterministicCompaction: true,
+	}
+	// two replicas fed the same writes, with all frozen skiplists flushed before closing
+	paths := []string{t.TempDir(), t.TempDir()}
+	for _, path := range paths {
+		db, err := Open(path, opts)
+		assert.NoError(t, err)
+		for i := 0; i < 600; i++ {
+			assert.NoError(t, db.Put(fmt.Sprintf("key-%03d", (i*37)%300), []byte(fmt.Sprintf("val-%d", i)), nil))
+			if i%100 == 99 {
+				assert.NoError(t, db.DeletePrefix(fmt.Sprintf("key-%d", i%3), nil))
+			}
+		}
+		waitForJobs(t, db)
+		assert.NoError(t, db.Close())
+	}
+
+	tableDirs := []string{filepath.Join(paths[0], defaultTableSubdir), filepath.Join(paths[1], defaultTableSubdir)}
+	names := listDir(t, tableDirs[0])
+	assert.Greater(t, len(names), 3)
+	assert.Equal(t, names, listDir(t, tableDirs[1]))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(tableDirs[0], name))
+		assert.NoError(t, err)
+		other, err := os.ReadFile(filepath.Join(tableDirs[1], name))
+		assert.NoError(t, err)
+		assert.Equal(t, data, other, name)
+	}
+}
+
+func TestCompactionDropsTombstones(t *testing.T) {
+	// L1 is the last level, nothing lies below it
+	opts := &Options{MemtableThreshold: 512, L0CompactionTrigger: 2, NumLevels: 2}
+	db, err := Open(t.TempDir(), opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%03d", i), make([]byte, 20), nil))
+	}
+	for i := 0; i < 300; i += 2 {
+		assert.NoError(t, db.Delete(fmt.Sprintf("key-%03d", i), nil))
+	}
+	assert.NoError(t, db.DeleteRange("key-100", "key-200", nil))
+	waitForJobs(t, db)
+
+	props, err := db.TableProperties()
+	assert.NoError(t, err)
+	l1 := 0
+	for _, p := range props {
+		if p.Level == 1 {
+			l1++
+			assert.Zero(t, p.Tombstones, p.Name)
+			assert.Zero(t, p.RangeTombstones, p.Name)
+		}
+	}
+	assert.NotZero(t, l1)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		_, err := db.Get(key, nil)
+		if i%2 == 0 || (i >= 100 && i < 200) {
+			assert.ErrorIs(t, err, ErrNotFound, key)
+		} else {
+			assert.NoError(t, err, key)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"kv/internal/compaction"
+	"kv/internal/memtable"
+	"kv/internal/ratelimit"
+	"kv/internal/wal"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lockFileName = "LOCK"
+)
+
+var (
+	ErrNotFound      = errors.New("kv: key not found")
+	ErrClosed        = errors.New("kv: db closed")
+	ErrLocked        = errors.New("kv: db directory locked by another process")
+	ErrCorrupt       = errors.New("kv: corrupt data")
+	ErrUnsorted      = errors.New("kv: keys not in ascending order")
+	ErrTooLarge      = errors.New("kv: key or value too large")
+	ErrInvalidPrefix = errors.New("kv: prefix without upper bound")
+	// a put of an existing key under Options.WriteOnce
+	ErrKeyExists = errors.New("kv: key exists")
+	// a read or write of a key the DB keeps for itself, see reservedPrefix
+	ErrReservedKey = errors.New("kv: key reserved by the db")
+)
+
+/*
+DB is an embeddable K/V store living in a single directory.
+Writes are appended to the WAL and then applied to the memtable, frozen skiplists are
+flushed to table files and the tables compacted in the background. Reads consult the
+memtable and then the tables. Open replays the WAL into an empty memtable, so nothing
+acknowledged is lost on restart. The directory is guarded by an exclusive lock on its LOCK
+file for as long as the DB is open.
+All methods are safe for concurrent use, Close included.
+*/
+type DB struct {
+	path string
+	opts *Options
+
+	lock *os.File
+	// the lock on the WAL directory if it lives outside of the DB directory
+	walLock *os.File
+	mt      *memtable.Memtable
+	wal     *wal.Writer
+	// the first WAL segment of every skiplist, parallel to the skiplists of the memtable
+	walStarts []uint64
+
+	// the tables of every level, L0 newest first, every other level in key order
+	levels      [][]*table
+	tablesMutex sync.RWMutex
+	// serializes changes to the levels and the MANIFEST and hands out table numbers
+	versionMutex sync.Mutex
+	nextTable    uint64
+
+	picker *compaction.Picker
+	// shared by all compactions, nil if they are not throttled
+	compactionLimiter *ratelimit.Limiter
+	// serializes flushes, which drop skiplists oldest first
+	flushMutex sync.Mutex
+
+	// the background jobs, see jobs.go
+	jobsMutex   sync.Mutex
+	jobs        int
+	compactions int
+	flushing    bool
+	// the tables being compacted
+	compacting map[uint64]bool
+	jobsClosed bool
+	jobsErr    error
+	jobsDone   sync.WaitGroup
+
+	closed  bool
+	rwMutex sync.RWMutex
+	// serializes writers so that the WAL and the memtable see mutations in the same order
+	writeMutex sync.Mutex
+
+	// stops the background WAL syncer of SyncPeriodic
+	stopSync chan struct{}
+	syncDone sync.WaitGroup
+}
+
+func Open(path string, opts *Options) (db *DB, err error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	walDir := opts.walDir(path)
+	if err := checkWALDir(path, walDir, opts); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(path, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLocked, err)
+	}
+	var walLock *os.File
+	var levels [][]*table
+	defer func() {
+		if err != nil {
+			closeLevels(levels)
+			unlockFile(lock)
+			if walLock != nil {
+				unlockFile(walLock)
+			}
+		}
+	}()
+
+	for _, dir := range []string{walDir, filepath.Join(path, opts.TableSubdir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	// make the entries of the subdirectories and the LOCK file durable
+	if err := syncDir(path); err != nil {
+		return nil, err
+	}
+	if opts.WALDir != "" {
+		if walLock, err = lockFile(filepath.Join(walDir, lockFileName)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrLocked, err)
+		}
+		if err := syncDir(filepath.Dir(filepath.Clean(walDir))); err != nil {
+			return nil, err
+		}
+	}
+
+	tableDir := filepath.Join(path, opts.TableSubdir)
+	levels, nextTable, err := openLevels(tableDir, opts.NumLevels)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeManifest(tableDir, levelsManifest(levels, nextTable)); err != nil {
+		return nil, err
+	}
+	mt := memtable.NewMemtable(opts.MemtableThreshold, opts.MaxSkiplistHeight, time.Now().UnixNano())
+	err = wal.Replay(walDir, opts.StrictWALRecovery, opts.OnReplayProgress, func(payload []byte) error {
+		return applyRecord(mt, payload)
+	})
+	if errors.Is(err, wal.ErrCorrupt) {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	w, err := wal.NewWriter(walDir, opts.walOptions())
+	if err != nil {
+		return nil, err
+	}
+	db = &DB{
+		path:    path,
+		opts:    opts,
+		lock:    lock,
+		walLock: walLock,
+		mt:      mt,
+		wal:     w,
+		// the replayed skiplists may hold records of any segment left from before
+		walStarts:  make([]uint64, mt.Len()),
+		levels:     levels,
+		nextTable:  nextTable,
+		picker:     compaction.NewPicker(opts.compactionOptions()),
+		compacting: map[uint64]bool{},
+		stopSync:   make(chan struct{}),
+	}
+	if opts.CompactionRateLimit > 0 {
+		db.compactionLimiter = ratelimit.New(opts.CompactionRateLimit)
+	}
+	if opts.SyncPolicy == SyncPeriodic {
+		db.syncDone.Add(1)
+		go db.syncPeriodically()
+	}
+	// flush the skiplists replayed and compact what was left from before
+	db.scheduleJobs()
+	return db, nil
+}
+
+// a WAL directory of its own must be neither the DB directory nor one of its subdirectories
+func checkWALDir(path, walDir string, opts *Options) error {
+	if opts.WALDir == "" {
+		return nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	absWALDir, err := filepath.Abs(walDir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absPath, absWALDir); err == nil && filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: WAL directory %q lies within the DB directory", ErrInvalidOptions, opts.WALDir)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+/*
+Fsync the WAL every SyncInterval till the DB is closed. A failed sync is retried on the
+next tick, Close syncs the WAL one last time anyway.
+*/
+func (db *DB) syncPeriodically() {
+	defer db.syncDone.Done()
+
+	ticker := time.NewTicker(db.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stopSync:
+			return
+		case <-ticker.C:
+			db.writeMutex.Lock()
+			db.wal.Sync()
+			db.writeMutex.Unlock()
+		}
+	}
+}
+
+/*
+Close moves the DB from open to closed exactly once. Every operation holds the read lock
+for its whole duration, so Close waits for the ones in flight to finish while operations
+arriving after it block till it is done and then fail with ErrClosed. Calling Close again,
+concurrently or not, returns ErrClosed as well.
+*/
+func (db *DB) Close() error {
+	db.rwMutex.Lock()
+	defer db.rwMutex.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	close(db.stopSync)
+	db.syncDone.Wait()
+	// the jobs in flight are finished, not abandoned
+	err := db.stopJobs()
+	if closeErr := db.wal.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := closeLevels(db.levels); err == nil {
+		err = closeErr
+	}
+	if db.walLock != nil {
+		if unlockErr := unlockFile(db.walLock); err == nil {
+			err = unlockErr
+		}
+	}
+	if unlockErr := unlockFile(db.lock); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// Get a copy of the value of key, the caller may modify it freely.
+func (db *DB) Get(key string, ro *ReadOptions) ([]byte, error) {
+	if reservedKey(key) {
+		return nil, fmt.Errorf("%w: %q", ErrReservedKey, key)
+	}
+	return db.get(key, ro)
+}
+
+// Get without refusing reserved keys.
+func (db *DB) get(key string, ro *ReadOptions) ([]byte, error) {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	val, ok, err := db.lookup(key, ro)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// val is shared with the memtable, or pins the whole table block it was read from
+	return append([]byte{}, val...), nil
+}
+
+// Report whether the key exists without handing out its value.
+func (db *DB) Has(key string, ro *ReadOptions) (bool, error) {
+	if reservedKey(key) {
+		return false, fmt.Errorf("%w: %q", ErrReservedKey, key)
+	}
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return false, ErrClosed
+	}
+	_, ok, err := db.lookup(key, ro)
+	return ok, err
+}
+
+/*
+Look up several keys at once. The i-th value and error belong to the i-th key, a missing
+key gets ErrNotFound. The memtable is read-locked only once for the whole lookup, only the
+keys it knows nothing about are looked up in the tables. The values are copies, as for Get.
+*/
+func (db *DB) MultiGet(keys []string, ro *ReadOptions) ([][]byte, []error) {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	errs := make([]error, len(keys))
+	if db.closed {
+		for i := range errs {
+			errs[i] = ErrClosed
+		}
+		return make([][]byte, len(keys)), errs
+	}
+	perf := ro.perf()
+	vals, founds := db.mt.MultiLookup(keys)
+	for i, found := range founds {
+		if reservedKey(keys[i]) {
+			vals[i], errs[i] = nil, fmt.Errorf("%w: %q", ErrReservedKey, keys[i])
+			continue
+		}
+		if !found {
+			vals[i], found, errs[i] = db.lookupTables(keys[i], ro)
+		} else if perf != nil {
+			perf.MemtableHits++
+		}
+		if errs[i] == nil && (!found || vals[i] == nil) {
+			vals[i], errs[i] = nil, ErrNotFound
+		} else if vals[i] != nil {
+			vals[i] = append([]byte{}, vals[i]...)
+		}
+	}
+	return vals, errs
+}
+
+func (db *DB) Put(key string, val []byte, wo *WriteOptions) error {
+	batch := NewWriteBatch()
+	batch.Put(key, val)
+	return db.Write(batch, wo)
+}
+
+func (db *DB) Delete(key string, wo *WriteOptions) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return db.Write(batch, wo)
+}
+
+/*
+Delete all keys in [start, end) by writing a single range tombstone, the keys in range are
+not visited. An empty or inverted range deletes nothing, one reaching into the reserved keys
+is refused with ErrReservedKey.
+*/
+func (db *DB) DeleteRange(start, end string, wo *WriteOptions) error {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if start >= end {
+		return nil
+	}
+	if reservedRange(start, end) {
+		return fmt.Errorf("%w: range [%q, %q)", ErrReservedKey, start, end)
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	return db.deleteRange(start, end, db.shouldSync(wo))
+}
+
+// The caller must hold writeMutex.
+func (db *DB) deleteRange(start, end string, sync bool) error {
+	if err := db.makeRoom(true); err != nil {
+		return err
+	}
+	if err := db.wal.Append(encodeRangeDelete(start, end), sync); err != nil {
+		return err
+	}
+	db.mt.DeleteRange(start, end)
+	return nil
+}
+
+/*
+Delete all keys starting with prefix by a range tombstone. Tables holding nothing but keys
+with the prefix are dropped right away instead of waiting for compaction to clean them up,
+so the tombstone is always synced first. Under DeterministicCompaction they are left to
+compaction as well. An empty prefix or one of 0xff bytes only has no
+upper bound and is refused with ErrInvalidPrefix.
+*/
+func (db *DB) DeletePrefix(prefix string, wo *WriteOptions) error {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	end, ok := prefixEnd(prefix)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidPrefix, prefix)
+	}
+	if reservedRange(prefix, end) {
+		return fmt.Errorf("%w: prefix %q", ErrReservedKey, prefix)
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	// the tables are taken before the tombstone is written, so they are all older than it.
+	// Which tables there are depends on the timing of flushes, so not if deterministic
+	dropped := map[uint64]bool{}
+	if !db.opts.DeterministicCompaction {
+		dropped = db.reserveTables(prefix, end)
+	}
+	defer db.releaseTables(dropped)
+	if err := db.deleteRange(prefix, end, true); err != nil {
+		return err
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	return db.applyEdit(versionEdit{removed: dropped})
+}
+
+// the smallest key behind all keys starting with prefix, false if there is none
+func prefixEnd(prefix string) (string, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1}), true
+		}
+	}
+	return "", false
+}
+
+/*
+Keys starting with reservedPrefix belong to the DB itself, they hold the blobs. Users can
+neither read nor write them, nor delete ranges reaching into them, and compaction filters
+never see them.
+*/
+const reservedPrefix = "\x00kv/"
+
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, reservedPrefix)
+}
+
+// whether [start, end) holds reserved keys
+func reservedRange(start, end string) bool {
+	reservedEnd, _ := prefixEnd(reservedPrefix)
+	return start < reservedEnd && reservedPrefix < end
+}
+
+// Apply all puts and deletes of the batch atomically.
+func (db *DB) Write(batch *WriteBatch, wo *WriteOptions) error {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	for _, kv := range batch.kvs {
+		if reservedKey(kv.Key) {
+			return fmt.Errorf("%w: %q", ErrReservedKey, kv.Key)
+		}
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	if db.opts.WriteOnce {
+		if err := db.checkWriteOnce(batch.kvs); err != nil {
+			return err
+		}
+	}
+	return db.apply(batch.kvs, wo)
+}
+
+// Log the mutations to the WAL and apply them to the memtable. The caller must hold writeMutex.
+func (db *DB) apply(kvs []memtable.KV, wo *WriteOptions) error {
+	if err := db.makeRoom(false); err != nil {
+		return err
+	}
+	if err := db.wal.Append(encodeBatch(kvs), db.shouldSync(wo)); err != nil {
+		return err
+	}
+	db.mt.UpdateBatch(kvs)
+	return nil
+}
+
+/*
+Reject the batch if it puts a key that exists, in the DB or earlier in the batch. Deletes
+go through. The caller must hold writeMutex, so no write slips in between the check and the
+batch.
+*/
+func (db *DB) checkWriteOnce(kvs []memtable.KV) error {
+	exists := map[string]bool{}
+	for _, kv := range kvs {
+		found, checked := exists[kv.Key]
+		if !checked {
+			_, ok, err := db.lookup(kv.Key, nil)
+			if err != nil {
+				return err
+			}
+			found = ok
+		}
+		if kv.Val != nil && found {
+			return fmt.Errorf("%w: %q", ErrKeyExists, kv.Key)
+		}
+		exists[kv.Key] = kv.Val != nil
+	}
+	return nil
+}
+
+// whether a write has to be fsynced before it is acknowledged
+func (db *DB) shouldSync(wo *WriteOptions) bool {
+	if wo != nil {
+		return wo.Sync
+	}
+	return db.opts.SyncPolicy == SyncAlways
+}
@@ -0,0 +1,440 @@
+package kv
+
+import (
+	"fmt"
+	"kv/test"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T) *DB {
+	db, err := Open(t.TempDir(), nil)
+	assert.NoError(t, err)
+	return db
+}
+
+func TestOpenClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := Open(path, &Options{})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(path, lockFileName))
+
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+}
+
+func TestOpenLocked(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = Open(path, nil)
+	assert.ErrorIs(t, err, ErrLocked)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	_, err := db.Get("key", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	ok, err := db.Has("key", nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	keys := test.RandStrs(16, 100)
+	for _, key := range keys {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	for _, key := range keys {
+		val, err := db.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, key, string(val))
+	}
+	for _, key := range keys[:50] {
+		assert.NoError(t, db.Delete(key, nil))
+	}
+	for i, key := range keys {
+		_, err := db.Get(key, nil)
+		ok, hasErr := db.Has(key, nil)
+		assert.NoError(t, hasErr)
+		if i < 50 {
+			assert.ErrorIs(t, err, ErrNotFound)
+			assert.False(t, ok)
+		} else {
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	}
+
+	assert.NoError(t, db.Put(keys[0], nil, nil))
+	val, err := db.Get(keys[0], nil)
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	ok, err = db.Has(keys[0], nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestEmptyKeysAndValues(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+
+	// an empty key and value take no bytes in the skiplist
+	assert.NoError(t, db.Put("", []byte{}, nil))
+	val, err := db.Get("", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	assert.NoError(t, db.Put("a", []byte{}, nil))
+	val, err = db.Get("", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	assert.NoError(t, db.Delete("", nil))
+	_, err = db.Get("", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get("", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	val, err = db.Get("a", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+}
+
+func TestDeleteEmptyKey(t *testing.T) {
+	// every write freezes the skiplist, so the delete lands in a fresh one above the value
+	db, err := Open(t.TempDir(), &Options{MemtableThreshold: 1})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.Put("", []byte("v"), nil))
+	assert.NoError(t, db.Delete("", nil))
+	_, err = db.Get("", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	waitForJobs(t, db)
+	_, err = db.Get("", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// a range delete after the tombstone goes to a skiplist of its own
+	assert.NoError(t, db.Put("b", []byte("v"), nil))
+	assert.NoError(t, db.Delete("", nil))
+	assert.NoError(t, db.DeleteRange("a", "c", nil))
+	assert.NoError(t, db.Put("", []byte("back"), nil))
+	val, err := db.Get("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "back", string(val))
+	_, err = db.Get("b", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestClosedDB(t *testing.T) {
+	db := openTestDB(t)
+	assert.NoError(t, db.Close())
+
+	_, err := db.Get("key", nil)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Has("key", nil)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, db.Put("key", []byte("val"), nil), ErrClosed)
+	assert.ErrorIs(t, db.Delete("key", nil), ErrClosed)
+	assert.ErrorIs(t, db.DeleteRange("a", "b", nil), ErrClosed)
+}
+
+func TestMultiGet(t *testing.T) {
+	db := openTestDB(t)
+	keys := test.RandStrs(16, 100)
+	for _, key := range keys[:50] {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	vals, errs := db.MultiGet(keys, nil)
+	assert.Equal(t, len(keys), len(vals))
+	for i, key := range keys {
+		if i < 50 {
+			assert.NoError(t, errs[i])
+			assert.Equal(t, key, string(vals[i]))
+		} else {
+			assert.ErrorIs(t, errs[i], ErrNotFound)
+			assert.Nil(t, vals[i])
+		}
+	}
+
+	assert.NoError(t, db.Close())
+	vals, errs = db.MultiGet(keys[:2], nil)
+	assert.Equal(t, [][]byte{nil, nil}, vals)
+	assert.ErrorIs(t, errs[0], ErrClosed)
+	assert.ErrorIs(t, errs[1], ErrClosed)
+}
+
+func TestGetReturnsCopies(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemtableThreshold: 1})
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.Put("key", []byte("hello"), nil))
+
+	check := func() {
+		val, err := db.Get("key", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(val))
+		val[0] = 'X'
+		vals, errs := db.MultiGet([]string{"key"}, nil)
+		assert.NoError(t, errs[0])
+		assert.Equal(t, "hello", string(vals[0]))
+		vals[0][0] = 'X'
+		val, err = db.Get("key", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(val))
+	}
+	check()
+	// and once more from a table, the next write freezes the skiplist holding the key
+	assert.NoError(t, db.Put("next", []byte("val"), nil))
+	waitForJobs(t, db)
+	assert.Equal(t, 1, db.mt.Len())
+	check()
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	assert.NoError(t, db.DeleteRange("b", "d", nil))
+	// an inverted range deletes nothing
+	assert.NoError(t, db.DeleteRange("d", "a", nil))
+
+	_, errs := db.MultiGet([]string{"a", "b", "c", "d"}, nil)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrNotFound)
+	assert.ErrorIs(t, errs[2], ErrNotFound)
+	assert.NoError(t, errs[3])
+
+	assert.NoError(t, db.Put("c", []byte("c"), nil))
+	val, err := db.Get("c", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(val))
+}
+
+func TestDeletePrefix(t *testing.T) {
+	path := t.TempDir()
+	opts := &Options{MemtableThreshold: 128, L0CompactionTrigger: 100}
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+	// every prefix fills tables of its own
+	for _, prefix := range []string{"a/", "b/", "c/"} {
+		for i := 0; i < 12; i++ {
+			assert.NoError(t, db.Put(fmt.Sprintf("%s%02d", prefix, i), make([]byte, 26), nil))
+		}
+	}
+	assert.NoError(t, db.Put("b", []byte("b"), nil))
+	assert.NoError(t, db.Put("b0", []byte("b0"), nil))
+	waitForJobs(t, db)
+	before, err := db.TableProperties()
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.DeletePrefix("b/", nil))
+	after, err := db.TableProperties()
+	assert.NoError(t, err)
+	assert.Less(t, len(after), len(before))
+	for _, props := range after {
+		assert.False(t, props.MinKey >= "b/" && props.MaxKey < "b0", props.Name)
+	}
+	assert.ErrorIs(t, db.DeletePrefix("", nil), ErrInvalidPrefix)
+	assert.ErrorIs(t, db.DeletePrefix("\xff\xff", nil), ErrInvalidPrefix)
+
+	check := func(db *DB) {
+		for _, prefix := range []string{"a/", "b/", "c/"} {
+			for i := 0; i < 12; i++ {
+				key := fmt.Sprintf("%s%02d", prefix, i)
+				_, err := db.Get(key, nil)
+				if prefix == "b/" {
+					assert.ErrorIs(t, err, ErrNotFound, key)
+				} else {
+					assert.NoError(t, err, key)
+				}
+			}
+		}
+		for _, key := range []string{"b", "b0"} {
+			_, err := db.Get(key, nil)
+			assert.NoError(t, err, key)
+		}
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expected := range map[string]string{"a": "b", "ab": "ac", "a\xff": "b", "a\xff\xff": "b"} {
+		end, ok := prefixEnd(prefix)
+		assert.True(t, ok)
+		assert.Equal(t, expected, end)
+	}
+	for _, prefix := range []string{"", "\xff"} {
+		_, ok := prefixEnd(prefix)
+		assert.False(t, ok)
+	}
+}
+
+func TestWriteOnce(t *testing.T) {
+	// a small memtable puts the first keys into tables
+	db, err := Open(t.TempDir(), &Options{WriteOnce: true, MemtableThreshold: 64})
+	assert.NoError(t, err)
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	assert.ErrorIs(t, db.Put("a", []byte("again"), nil), ErrKeyExists)
+	assert.ErrorIs(t, db.Put("d", []byte("again"), nil), ErrKeyExists)
+
+	// the whole batch is rejected
+	batch := NewWriteBatch()
+	batch.Put("e", []byte("e"))
+	batch.Put("b", []byte("again"))
+	assert.ErrorIs(t, db.Write(batch, nil), ErrKeyExists)
+	_, err = db.Get("e", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+	batch = NewWriteBatch()
+	batch.Put("e", []byte("e"))
+	batch.Put("e", []byte("again"))
+	assert.ErrorIs(t, db.Write(batch, nil), ErrKeyExists)
+
+	// deleted keys can be put again
+	assert.NoError(t, db.Delete("a", nil))
+	assert.NoError(t, db.DeleteRange("c", "d", nil))
+	assert.NoError(t, db.Put("a", []byte("new"), nil))
+	batch = NewWriteBatch()
+	batch.Delete("b")
+	batch.Put("b", []byte("new"))
+	batch.Put("c", []byte("new"))
+	assert.NoError(t, db.Write(batch, nil))
+	for _, key := range []string{"a", "b", "c"} {
+		val, err := db.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "new", string(val))
+	}
+}
+
+func TestReopenReplaysWAL(t *testing.T) {
+	path := t.TempDir()
+	// a small segment size spreads the WAL over many segments
+	db, err := Open(path, &Options{SyncPolicy: SyncNever, WALSegmentSize: 256})
+	assert.NoError(t, err)
+	keys := test.RandStrs(16, 100)
+	for _, key := range keys {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	for _, key := range keys[:10] {
+		assert.NoError(t, db.Delete(key, &WriteOptions{Sync: true}))
+	}
+	assert.NoError(t, db.Put("a", nil, nil))
+	assert.NoError(t, db.DeleteRange("b", "d", nil))
+	assert.NoError(t, db.Put("c", []byte("c"), nil))
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	for i, key := range keys {
+		val, err := db.Get(key, nil)
+		if i < 10 || ("b" <= key && key < "d") {
+			assert.ErrorIs(t, err, ErrNotFound)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, key, string(val))
+		}
+	}
+	val, err := db.Get("a", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	val, err = db.Get("c", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(val))
+}
+
+func TestOpenTornWAL(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("kept", []byte("val"), nil))
+	assert.NoError(t, db.Put("torn", []byte("val"), nil))
+	assert.NoError(t, db.Close())
+
+	walPath := filepath.Join(path, defaultWALSubdir, "000001.log")
+	info, err := os.Stat(walPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(walPath, info.Size()-1))
+	_, err = Open(path, &Options{StrictWALRecovery: true})
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get("kept", nil)
+	assert.NoError(t, err)
+	_, err = db.Get("torn", nil)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestConcurrentClose(t *testing.T) {
+	db := openTestDB(t)
+	var wg sync.WaitGroup
+	for _, key := range test.RandStrs(16, 100) {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			// every operation either completes before Close or fails with ErrClosed
+			if err := db.Put(key, []byte(key), nil); err != nil {
+				assert.ErrorIs(t, err, ErrClosed)
+				return
+			}
+			if val, err := db.Get(key, nil); err == nil {
+				assert.Equal(t, key, string(val))
+			} else {
+				assert.ErrorIs(t, err, ErrClosed)
+			}
+			if err := db.Delete(key, nil); err != nil {
+				assert.ErrorIs(t, err, ErrClosed)
+			}
+		}(key)
+	}
+	closeErrs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			closeErrs <- db.Close()
+		}()
+	}
+	wg.Wait()
+	close(closeErrs)
+
+	// exactly one Close wins
+	closed := 0
+	for err := range closeErrs {
+		if err == nil {
+			closed++
+		} else {
+			assert.ErrorIs(t, err, ErrClosed)
+		}
+	}
+	assert.Equal(t, 1, closed)
+}
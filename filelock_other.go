@@ -0,0 +1,16 @@
+//go:build !unix
+
+package kv
+
+import (
+	"os"
+)
+
+// Without flock the LOCK file is only created, it does not keep other processes out.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func unlockFile(file *os.File) error {
+	return file.Close()
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package kv
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Hold an exclusive advisory lock on the LOCK file so that only one process at a time opens
+the same directory. The lock is released by the OS if the process dies, so a crash never
+leaves a stale lock behind.
+*/
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
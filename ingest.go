@@ -0,0 +1,176 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"kv/internal/sstable"
+	"os"
+	"path/filepath"
+)
+
+/*
+TableWriter builds a table file outside of the DB, to be handed to IngestSSTable for bulk
+loading. Keys must be added in strictly ascending order, puts and deletes alike.
+*/
+type TableWriter struct {
+	w *sstable.Writer
+}
+
+// Start a table at path, its data blocks are compressed and filtered as opts tells.
+func NewTableWriter(path string, opts *Options) (*TableWriter, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	w, err := sstable.NewWriter(path, opts.tableOptions())
+	if err != nil {
+		return nil, err
+	}
+	return &TableWriter{w: w}, nil
+}
+
+func (writer *TableWriter) Put(key string, val []byte) error {
+	// a nil val marks a deletion in the table
+	if val == nil {
+		val = []byte{}
+	}
+	return writerErr(writer.w.Add(key, val))
+}
+
+// Add a tombstone, the key is deleted from the DB the table is ingested into.
+func (writer *TableWriter) Delete(key string) error {
+	return writerErr(writer.w.Add(key, nil))
+}
+
+// surface the rejected pairs of the table writer as errors of this package
+func writerErr(err error) error {
+	switch {
+	case errors.Is(err, sstable.ErrUnsorted):
+		return fmt.Errorf("%w: %v", ErrUnsorted, err)
+	case errors.Is(err, sstable.ErrTooLarge):
+		return fmt.Errorf("%w: %v", ErrTooLarge, err)
+	}
+	return err
+}
+
+// Delete all keys in [start, end) of the DB the table is ingested into. Unlike keys, range
+// tombstones may be added in any order.
+func (writer *TableWriter) DeleteRange(start, end string) {
+	if start < end {
+		writer.w.AddRangeTombstone(start, end)
+	}
+}
+
+// Make the table durable at its path.
+func (writer *TableWriter) Finish() error {
+	return writer.w.Finish()
+}
+
+// Give up the table and remove what has been written so far.
+func (writer *TableWriter) Abort() {
+	writer.w.Abort()
+}
+
+/*
+Validate the table at path and add a copy of it to the DB as the newest L0 table, without
+passing its KV pairs through the WAL and the memtable. The memtable is flushed beforehand,
+so the table shadows everything written before IngestSSTable and is shadowed by everything
+written after it. The file at path is left untouched. A table holding reserved keys is
+refused with ErrReservedKey.
+*/
+func (db *DB) IngestSSTable(path string) error {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+
+	// freeze and flush the memtable, a mutable skiplist holding nothing but range tombstones
+	// would still shadow the table
+	if !db.mt.MutableEmpty() {
+		if err := db.freeze(); err != nil {
+			return err
+		}
+	}
+	if err := db.flushFrozen(); err != nil {
+		return err
+	}
+	tableDir := filepath.Join(db.path, db.opts.TableSubdir)
+	num := db.newTableNum()
+	dst := filepath.Join(tableDir, tableName(num))
+	if err := copyFile(path, dst+tmpSuffix); err != nil {
+		os.Remove(dst + tmpSuffix)
+		return err
+	}
+	// the copy is what gets added, so it is the one verified
+	if err := verifyTable(dst + tmpSuffix); err != nil {
+		os.Remove(dst + tmpSuffix)
+		return err
+	}
+	if err := os.Rename(dst+tmpSuffix, dst); err != nil {
+		os.Remove(dst + tmpSuffix)
+		return err
+	}
+	if err := syncDir(tableDir); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	db.flushMutex.Lock()
+	defer db.flushMutex.Unlock()
+	return db.addL0(tableDir, num)
+}
+
+// check that the table is intact and keeps out of the reserved keys
+func verifyTable(path string) error {
+	table, err := sstable.Open(path)
+	if err != nil {
+		return corruptErr(err)
+	}
+	defer table.Close()
+	if err := table.Verify(); err != nil {
+		return corruptErr(err)
+	}
+	for _, t := range table.RangeTombstones() {
+		if reservedRange(t.Start, t.End) {
+			return fmt.Errorf("%w: range tombstone [%q, %q)", ErrReservedKey, t.Start, t.End)
+		}
+	}
+	props := table.Properties()
+	if props.Entries == 0 || !reservedRange(props.MinKey, props.MaxKey+"\x00") {
+		return nil
+	}
+	it := table.NewIterator(nil)
+	for ; it.HasNext(); it.Next() {
+		if reservedKey(it.Key()) {
+			return fmt.Errorf("%w: %q", ErrReservedKey, it.Key())
+		}
+	}
+	return corruptErr(it.Err())
+}
+
+// copy src to a new file at dst and make it durable
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
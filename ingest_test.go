@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestSSTable(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("a", []byte("old"), nil))
+	assert.NoError(t, db.Put("b", []byte("old"), nil))
+	assert.NoError(t, db.Put("c", []byte("old"), nil))
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	w, err := NewTableWriter(external, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Put("a", []byte("ingested")))
+	assert.NoError(t, w.Delete("b"))
+	assert.ErrorIs(t, w.Put("a", []byte("back")), ErrUnsorted)
+	assert.NoError(t, w.Put("d", []byte("ingested")))
+	w.DeleteRange("x", "z")
+	assert.NoError(t, w.Finish())
+
+	assert.NoError(t, db.Put("y", []byte("old"), nil))
+	assert.NoError(t, db.IngestSSTable(external))
+	assert.FileExists(t, external)
+	// the ingested table shadows earlier writes, later writes shadow the table
+	assert.NoError(t, db.Put("d", []byte("new"), nil))
+	check := func(db *DB) {
+		for key, expected := range map[string]string{"a": "ingested", "c": "old", "d": "new"} {
+			val, err := db.Get(key, nil)
+			assert.NoError(t, err, key)
+			assert.Equal(t, expected, string(val), key)
+		}
+		for _, key := range []string{"b", "y"} {
+			_, err := db.Get(key, nil)
+			assert.ErrorIs(t, err, ErrNotFound, key)
+		}
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
+
+func TestIngestInvalidSSTable(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	assert.NoError(t, os.WriteFile(external, []byte("not a table"), 0644))
+	assert.ErrorIs(t, db.IngestSSTable(external), ErrCorrupt)
+	assert.Error(t, db.IngestSSTable(filepath.Join(t.TempDir(), "absent.sst")))
+	assert.Equal(t, []string{manifestName}, listDir(t, filepath.Join(path, defaultTableSubdir)))
+
+	assert.NoError(t, db.Close())
+	assert.ErrorIs(t, db.IngestSSTable(external), ErrClosed)
+}
+
+func TestIngestAfterDeleteRange(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("a", []byte("old"), nil))
+	// the range tombstone starts a skiplist of its own, which holds no keys
+	assert.NoError(t, db.DeleteRange("a", "z", nil))
+
+	external := filepath.Join(t.TempDir(), "bulk.sst")
+	w, err := NewTableWriter(external, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Put("b", []byte("ingested")))
+	assert.NoError(t, w.Finish())
+	assert.NoError(t, db.IngestSSTable(external))
+
+	check := func(db *DB) {
+		val, err := db.Get("b", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "ingested", string(val))
+		_, err = db.Get("a", nil)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
@@ -1,29 +1,42 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 )
 
 /*
 The B+tree structure of LSM-tree.
 Treat nodes of BTrees as binary to simplify loads and dumps with disks.
 Assign fixed 4 KB space for each node. (The same as a disk page)
-Each internal node has at least 1 child pointer. Say an internal node has 3 child pointers,
-[a, b, c], it has 4 subranges: (-inf, a), [a, b), [b, c), [c, inf). If the parent range of
-this node is [e, f), then the 1st and last subrange can be converted into [e, a) and [c, f)
+Each internal node has at least 1 child pointer. Each child pointer comes with a separator
+key, the i-th child covers the keys in [sep_i, sep_i+1). Say an internal node has 3 child
+pointers with separators [a, b, c], the subranges are (-inf, b), [b, c), [c, inf). The 1st
+separator is never consulted and is stored empty. If the parent range of this node is [e, f),
+then the 1st and last subrange can be converted into [e, b) and [c, f). Separators are the
+shortest keys splitting adjacent subtrees rather than full keys (see shortestSeparator).
 
 
 An internal node layout:
-|             header            |          data           |
-| type | count | size | padding | child_pointers | unused |
-|  2B  |  2B   |  2B  |   2B    |   count * 8B   |  ...   |
+|                  header                |                        data                        |
+| type | count | size | padding | unused | child_pointers | sep_offsets | sep_data | unused |
+|  2B  |  2B   |  2B  |   2B    |   8B   |   count * 8B   | count * 2B  |   ...    |  ...   |
+where each sep_offset is the index(relative to the beginning of the sep_data part) of the first byte of a separator.
+
+A separator layout:
+| key_len | key |
+|   2B    | ... |
 
 A leaf node layout:
-|             header            |               data             |
-| type | count | size | padding | kv_offsets  | kv_data | unused |
-|  2B  |  2B   |  2B  |   2B    | count * 2B  |   ...   |  ...   |
+|                  header                 |               data             |
+| type | count | size | padding | next    | kv_offsets  | kv_data | unused |
+|  2B  |  2B   |  2B  |   2B    |   8B    | count * 2B  |   ...   |  ...   |
 where each kv_offset is the index(relative to the beginning of the kv_data part) of the first byte of a KV pair.
+next is the pointer to the right sibling leaf (0 for the last leaf), so that range scans can
+stream leaf-to-leaf without re-descending from the root.
 
 A KV pair layout:
 | key_len | val_len | key | val |
@@ -35,6 +48,8 @@ type BTree struct {
 
 	get func(uint64) []byte
 	new func([]byte) uint64
+	// overwrite the page at a pointer, inserts update nodes in place
+	set func(uint64, []byte)
 	del func(uint64)
 }
 
@@ -59,19 +74,33 @@ func getTypeLiteral(type_ BTreeNodeType) string {
 	return typeLiteralLeaf
 }
 
+const (
+	// every node occupies exactly one disk page
+	pageSize = 4096
+)
+
 const (
 	headerOffset = 0
-	headerLen    = 8
+	headerLen    = 16
 	typeOffset   = 0
 	typeLen      = 2
 	countOffset  = 2
 	countLen     = 2
 	sizeOffset   = 4
 	sizeLen      = 2
+	nextOffset   = 8
+	nextLen      = 8
+	// the pointer value of "no node"
+	nilPtr = uint64(0)
 )
 
-func getSlice(slice []byte, offset uint16, len uint16) []byte {
-	return slice[offset : offset+len]
+// offsets are widened to int so that offset+len can never wrap around uint16
+func getSlice(slice []byte, offset uint16, len_ uint16) []byte {
+	end := int(offset) + int(len_)
+	if end > len(slice) {
+		panicSliceOutOfBound(int(offset), end, len(slice))
+	}
+	return slice[offset:end]
 }
 
 func (node BTreeNode) getType() BTreeNodeType {
@@ -87,6 +116,9 @@ func (node BTreeNode) getCount() uint16 {
 }
 
 func (node BTreeNode) setCount(count uint16) {
+	if maxCount := (pageSize - dataOffset) / getEntryLen(node.getType()); int(count) > maxCount {
+		panicOutOfBound(count, uint16(maxCount+1))
+	}
 	binary.LittleEndian.PutUint16(getSlice(node, countOffset, countLen), count)
 }
 
@@ -95,12 +127,29 @@ func (node BTreeNode) getSize() uint16 {
 }
 
 func (node BTreeNode) setSize(size uint16) {
+	if size > pageSize {
+		panicBadSize(int(size), 0, pageSize)
+	}
 	binary.LittleEndian.PutUint16(getSlice(node, sizeOffset, sizeLen), size)
 }
 
+func (node BTreeNode) getNext() uint64 {
+	node.checkType(leaf)
+	return binary.LittleEndian.Uint64(getSlice(node, nextOffset, nextLen))
+}
+
+func (node BTreeNode) setNext(ptr uint64) {
+	node.checkType(leaf)
+	binary.LittleEndian.PutUint64(getSlice(node, nextOffset, nextLen), ptr)
+}
+
 const (
-	panicTypeMismatchMsg = "expected %v but got %v"
-	panicOutOfBoundMsg   = "index %d out of bound %d"
+	panicTypeMismatchMsg  = "expected %v but got %v"
+	panicOutOfBoundMsg    = "index %d out of bound %d"
+	panicUnknownTypeMsg   = "unknown node type %d"
+	panicBadSizeMsg       = "node size %d out of range [%d, %d]"
+	panicSliceMsg         = "slice [%d, %d) out of bound %d"
+	panicUnorderedKeysMsg = "keys %q and %q are not in ascending order"
 )
 
 func panicOutOfBound(idx uint16, bound uint16) {
@@ -111,6 +160,22 @@ func panicTypeMismatch(expected BTreeNodeType, actual BTreeNodeType) {
 	panic(fmt.Sprintf(panicTypeMismatchMsg, getTypeLiteral(expected), getTypeLiteral(actual)))
 }
 
+func panicUnknownType(type_ BTreeNodeType) {
+	panic(fmt.Sprintf(panicUnknownTypeMsg, type_))
+}
+
+func panicBadSize(size int, lower int, upper int) {
+	panic(fmt.Sprintf(panicBadSizeMsg, size, lower, upper))
+}
+
+func panicSliceOutOfBound(start int, end int, bound int) {
+	panic(fmt.Sprintf(panicSliceMsg, start, end, bound))
+}
+
+func panicUnorderedKeys(prev []byte, next []byte) {
+	panic(fmt.Sprintf(panicUnorderedKeysMsg, prev, next))
+}
+
 func (node BTreeNode) checkType(type_ BTreeNodeType) {
 	if nodeType := node.getType(); nodeType != type_ {
 		panicTypeMismatch(type_, node.getType())
@@ -123,8 +188,37 @@ func (node BTreeNode) checkIdx(idx uint16) {
 	}
 }
 
+/*
+Sanity check of a node header read from a page before any data accessor trusts it.
+The type must be known, the size must cover the header and fit in the page, and the
+fixed-size index part (child pointers or KV offsets) must fit in the data part.
+*/
+func (node BTreeNode) checkHeader() {
+	if len(node) < headerLen {
+		panicBadSize(len(node), headerLen, pageSize)
+	}
+	if size := int(node.getSize()); size < headerLen || size > len(node) || size > pageSize {
+		panicBadSize(size, headerLen, min(len(node), pageSize))
+	}
+	entryLen := getEntryLen(node.getType())
+	if count := int(node.getCount()); count*entryLen > int(node.getSize())-dataOffset {
+		panicBadSize(dataOffset+count*entryLen, headerLen, int(node.getSize()))
+	}
+}
+
+/*
+Load the node stored at ptr. This is the boundary where a corrupted page turns into
+ErrCorruption (see recoverInvariant).
+*/
+func (tree *BTree) loadNode(ptr uint64) (node BTreeNode, err error) {
+	defer recoverInvariant(&err)
+	raw := BTreeNode(tree.get(ptr))
+	raw.checkHeader()
+	return raw, nil
+}
+
 const (
-	dataOffset  = 8
+	dataOffset  = 16
 	childPtrLen = 8
 	// within the data part
 	kvOffsetOffset = 0
@@ -137,39 +231,748 @@ const (
 	keyOffset      = 4
 )
 
+var ErrNodeFull = errors.New("btree: node full")
+
+/*
+The longest key allowed. A separator is at most as long as its key, so an entry of a child
+takes at most a quarter of the data part of an internal node. A full node, one without room
+for another such entry, thus splits into two halves with room for one more entry each.
+*/
+const maxKeyLen = (pageSize-dataOffset)/4 - childPtrLen - kvOffsetLen - keyLenLen
+
+// the byte length of a fixed-size entry in the index part of the data
+func getEntryLen(type_ BTreeNodeType) int {
+	switch type_ {
+	case internal:
+		return childPtrLen + kvOffsetLen
+	case leaf:
+		return kvOffsetLen
+	}
+	panicUnknownType(type_)
+	return 0
+}
+
 func (node BTreeNode) getData() []byte {
-	return getSlice(node, dataOffset, node.getSize()-dataOffset)
+	size := node.getSize()
+	if size < dataOffset {
+		panicBadSize(int(size), dataOffset, pageSize)
+	}
+	return getSlice(node, dataOffset, size-dataOffset)
 }
 
 func (node BTreeNode) getChildPtr(idx uint16) uint64 {
 	node.checkType(internal)
 	node.checkIdx(idx)
-	return binary.LittleEndian.Uint64(getSlice(node.getData(), idx*childPtrLen, childPtrLen))
+	return binary.LittleEndian.Uint64(node.getChildPtrSlice(idx))
 }
 
-// TODO: Check data out of 4 KB limitation.
 func (node BTreeNode) setChildPtr(idx uint16, ptr uint64) {
 	node.checkType(internal)
 	node.checkIdx(idx)
-	binary.LittleEndian.PutUint64(getSlice(node.getData(), idx*childPtrLen, childPtrLen), ptr)
+	binary.LittleEndian.PutUint64(node.getChildPtrSlice(idx), ptr)
+}
+
+func (node BTreeNode) getChildPtrSlice(idx uint16) []byte {
+	data := node.getData()
+	start := int(idx) * childPtrLen
+	if start+childPtrLen > len(data) {
+		panicSliceOutOfBound(start, start+childPtrLen, len(data))
+	}
+	return data[start : start+childPtrLen]
+}
+
+func (node BTreeNode) getSeparator(idx uint16) []byte {
+	node.checkType(internal)
+	node.checkIdx(idx)
+
+	count := int(node.getCount())
+	data := node.getData()
+	sepsStart := count * (childPtrLen + kvOffsetLen)
+	if sepsStart > len(data) {
+		panicSliceOutOfBound(0, sepsStart, len(data))
+	}
+
+	sepOffsets := data[count*childPtrLen : sepsStart]
+	sepOffset := binary.LittleEndian.Uint16(sepOffsets[int(idx)*kvOffsetLen:])
+	seps := data[sepsStart:]
+	if int(sepOffset) > len(seps) {
+		panicSliceOutOfBound(int(sepOffset), int(sepOffset), len(seps))
+	}
+	sep := seps[sepOffset:]
+	keyLen := binary.LittleEndian.Uint16(getSlice(sep, keyLenOffset, keyLenLen))
+	return getSlice(sep, keyLenLen, keyLen)
+}
+
+/*
+Append a child pointer with its separator to an internal node. The separator data part is
+shifted by one pointer slot plus one offset slot, and the offsets by one pointer slot, to
+make room for the new entry. ErrNodeFull is returned, leaving the node untouched, if the
+entry does not fit in the page so that the caller can split the node.
+*/
+func (node BTreeNode) appendChild(ptr uint64, sep []byte) error {
+	node.checkType(internal)
+	count, size := int(node.getCount()), int(node.getSize())
+	ptrsEnd := dataOffset + count*childPtrLen
+	sepOffsetsEnd := ptrsEnd + count*kvOffsetLen
+	if sepOffsetsEnd > size || size > len(node) {
+		panicBadSize(size, sepOffsetsEnd, len(node))
+	}
+	newSize := size + childPtrLen + kvOffsetLen + keyLenLen + len(sep)
+	if newSize > pageSize || newSize > len(node) {
+		return ErrNodeFull
+	}
+
+	copy(node[sepOffsetsEnd+childPtrLen+kvOffsetLen:], node[sepOffsetsEnd:size])
+	copy(node[ptrsEnd+childPtrLen:], node[ptrsEnd:sepOffsetsEnd])
+	binary.LittleEndian.PutUint64(node[ptrsEnd:], ptr)
+	binary.LittleEndian.PutUint16(node[sepOffsetsEnd+childPtrLen:], uint16(size-sepOffsetsEnd))
+
+	newSep := node[size+childPtrLen+kvOffsetLen : newSize]
+	binary.LittleEndian.PutUint16(newSep[keyLenOffset:], uint16(len(sep)))
+	copy(newSep[keyLenLen:], sep)
+
+	node.setCount(uint16(count + 1))
+	node.setSize(uint16(newSize))
+	return nil
+}
+
+// the index of the child covering key, i.e. the last child whose separator <= key
+func (node BTreeNode) searchChild(key []byte) uint16 {
+	node.checkType(internal)
+	lo, hi := uint16(1), node.getCount()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if bytes.Compare(node.getSeparator(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo - 1
+}
+
+/*
+Append a KV pair to a leaf node. The KV data part is shifted by one offset slot to make room
+for the new offset. ErrNodeFull is returned, leaving the node untouched, if the pair does
+not fit in the page; this also covers keys and values whose lengths exceed uint16.
+*/
+func (node BTreeNode) appendKV(key []byte, val []byte) error {
+	node.checkType(leaf)
+	count, size := int(node.getCount()), int(node.getSize())
+	kvPairsStart := dataOffset + count*kvOffsetLen
+	if kvPairsStart > size || size > len(node) {
+		panicBadSize(size, kvPairsStart, len(node))
+	}
+	kvPairLen := keyOffset + len(key) + len(val)
+	newSize := size + kvOffsetLen + kvPairLen
+	if newSize > pageSize || newSize > len(node) {
+		return ErrNodeFull
+	}
+
+	copy(node[kvPairsStart+kvOffsetLen:], node[kvPairsStart:size])
+	binary.LittleEndian.PutUint16(node[kvPairsStart:], uint16(size-kvPairsStart))
+
+	kvPair := node[size+kvOffsetLen : newSize]
+	binary.LittleEndian.PutUint16(kvPair[keyLenOffset:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(kvPair[valueLenOffset:], uint16(len(val)))
+	copy(kvPair[keyOffset:], key)
+	copy(kvPair[keyOffset+len(key):], val)
+
+	node.setCount(uint16(count + 1))
+	node.setSize(uint16(newSize))
+	return nil
 }
 
 func (node BTreeNode) getKV(idx uint16) ([]byte, []byte) {
 	node.checkType(leaf)
 	node.checkIdx(idx)
 
-	count := node.getCount()
+	count := int(node.getCount())
 	data := node.getData()
+	if count*kvOffsetLen > len(data) {
+		panicSliceOutOfBound(0, count*kvOffsetLen, len(data))
+	}
 
 	kvOffsets := data[:count*kvOffsetLen]
-	kvOffset := binary.LittleEndian.Uint16(getSlice(kvOffsets, idx*kvOffsetLen, kvOffsetLen))
+	kvOffset := binary.LittleEndian.Uint16(kvOffsets[int(idx)*kvOffsetLen:])
 
 	kvPairs := data[count*kvOffsetLen:]
+	if int(kvOffset) > len(kvPairs) {
+		panicSliceOutOfBound(int(kvOffset), int(kvOffset), len(kvPairs))
+	}
 	kvPair := kvPairs[kvOffset:]
 
 	keyLen := binary.LittleEndian.Uint16(getSlice(kvPair, keyLenOffset, keyLenLen))
 	valueLen := binary.LittleEndian.Uint16(getSlice(kvPair, valueLenOffset, valueLenLen))
-	kvPair = getSlice(kvPair, 0, keyLenLen+valueLenLen+keyLen+valueLen)
+	if end := keyOffset + int(keyLen) + int(valueLen); end > len(kvPair) {
+		panicSliceOutOfBound(0, end, len(kvPair))
+	}
 
 	return getSlice(kvPair, keyOffset, keyLen), getSlice(kvPair, keyOffset+keyLen, valueLen)
 }
+
+/*
+Visit the nodes of the tree level by level, from the root down to the leaves and from left
+to right within a level. A level is fully loaded before it is visited. The traversal stops
+at the first error returned by visit.
+*/
+func (tree *BTree) levelOrder(visit func(level int, ptrs []uint64, nodes []BTreeNode) error) (err error) {
+	defer recoverInvariant(&err)
+	if tree.rootPtr == nilPtr {
+		return nil
+	}
+	ptrs := []uint64{tree.rootPtr}
+	for level := 0; len(ptrs) > 0; level++ {
+		nodes := make([]BTreeNode, 0, len(ptrs))
+		childPtrs := []uint64{}
+		for _, ptr := range ptrs {
+			node, err := tree.loadNode(ptr)
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, node)
+			if node.getType() == leaf {
+				continue
+			}
+			for i := uint16(0); i < node.getCount(); i++ {
+				childPtrs = append(childPtrs, node.getChildPtr(i))
+			}
+		}
+		if err := visit(level, ptrs, nodes); err != nil {
+			return err
+		}
+		ptrs = childPtrs
+	}
+	return nil
+}
+
+/*
+Check that all leaves sit at the same depth and that the sibling chain links every leaf to
+its right neighbour in key order, with the last leaf pointing to nilPtr.
+*/
+func (tree *BTree) ValidateSiblings() error {
+	leafLevel := -1
+	return tree.levelOrder(func(level int, ptrs []uint64, nodes []BTreeNode) error {
+		leaves := 0
+		for i, node := range nodes {
+			if node.getType() != leaf {
+				continue
+			}
+			leaves++
+			if leafLevel == -1 {
+				leafLevel = level
+			}
+			if level != leafLevel {
+				return fmt.Errorf("%w: leaf %d at level %d, expected level %d", ErrCorruption, ptrs[i], level, leafLevel)
+			}
+			expectedNext := nilPtr
+			if i+1 < len(ptrs) {
+				expectedNext = ptrs[i+1]
+			}
+			if next := node.getNext(); next != expectedNext {
+				return fmt.Errorf("%w: leaf %d points to %d, expected %d", ErrCorruption, ptrs[i], next, expectedNext)
+			}
+		}
+		if leaves != 0 && leaves != len(nodes) {
+			return fmt.Errorf("%w: level %d mixes leaf and internal nodes", ErrCorruption, level)
+		}
+		return nil
+	})
+}
+
+func (tree *BTree) firstLeaf() (ptr uint64, err error) {
+	return tree.edgeLeaf(false)
+}
+
+func (tree *BTree) lastLeaf() (ptr uint64, err error) {
+	return tree.edgeLeaf(true)
+}
+
+// descend along the leftmost or rightmost child pointers down to a leaf
+func (tree *BTree) edgeLeaf(rightmost bool) (ptr uint64, err error) {
+	defer recoverInvariant(&err)
+	ptr = tree.rootPtr
+	for ptr != nilPtr {
+		node, err := tree.loadNode(ptr)
+		if err != nil {
+			return nilPtr, err
+		}
+		if node.getType() == leaf {
+			return ptr, nil
+		}
+		idx := uint16(0)
+		if rightmost {
+			idx = node.getCount() - 1
+		}
+		ptr = node.getChildPtr(idx)
+	}
+	return nilPtr, nil
+}
+
+// the key at either end of an edge leaf, nil for an empty tree
+func (tree *BTree) edgeKey(rightmost bool) (key []byte, err error) {
+	defer recoverInvariant(&err)
+	ptr, err := tree.edgeLeaf(rightmost)
+	if err != nil || ptr == nilPtr {
+		return nil, err
+	}
+	node, err := tree.loadNode(ptr)
+	if err != nil || node.getCount() == 0 {
+		return nil, err
+	}
+	idx := uint16(0)
+	if rightmost {
+		idx = node.getCount() - 1
+	}
+	key, _ = node.getKV(idx)
+	return key, nil
+}
+
+// The smallest key of the tree, nil if the tree is empty.
+func (tree *BTree) FirstKey() ([]byte, error) {
+	return tree.edgeKey(false)
+}
+
+// The largest key of the tree, nil if the tree is empty.
+func (tree *BTree) LastKey() ([]byte, error) {
+	return tree.edgeKey(true)
+}
+
+type BTreeStats struct {
+	// number of levels, 1 for a tree made of a single leaf and 0 for an empty tree
+	Height    int
+	PageCount int
+	LeafCount int
+	KVCount   int
+}
+
+// Walk the whole page graph once to compute the stats of the tree.
+func (tree *BTree) Stats() (BTreeStats, error) {
+	stats := BTreeStats{}
+	err := tree.levelOrder(func(level int, ptrs []uint64, nodes []BTreeNode) error {
+		stats.Height = level + 1
+		stats.PageCount += len(nodes)
+		for _, node := range nodes {
+			if node.getType() == leaf {
+				stats.LeafCount++
+				stats.KVCount += int(node.getCount())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return BTreeStats{}, err
+	}
+	return stats, nil
+}
+
+func (tree *BTree) Height() (int, error) {
+	stats, err := tree.Stats()
+	return stats.Height, err
+}
+
+func (tree *BTree) PageCount() (int, error) {
+	stats, err := tree.Stats()
+	return stats.PageCount, err
+}
+
+/*
+Stream all KV pairs in key order by descending once to the leftmost leaf and then following
+the sibling chain. The scan stops early when fn returns false.
+*/
+func (tree *BTree) scan(fn func(key []byte, val []byte) bool) (err error) {
+	defer recoverInvariant(&err)
+	ptr, err := tree.firstLeaf()
+	for err == nil && ptr != nilPtr {
+		var node BTreeNode
+		if node, err = tree.loadNode(ptr); err != nil {
+			return err
+		}
+		for i := uint16(0); i < node.getCount(); i++ {
+			if !fn(node.getKV(i)) {
+				return nil
+			}
+		}
+		ptr = node.getNext()
+	}
+	return err
+}
+
+type KV struct {
+	Key []byte
+	Val []byte
+}
+
+var ErrUnsortedBatch = errors.New("btree: batch keys are not strictly ascending")
+
+/*
+Insert a batch of KV pairs sorted by key in ascending order, replacing the values of existing
+keys. An empty tree is built bottom-up in one go. Otherwise the batch is split into runs of
+keys landing in the same leaf: every run descends once from the root, splitting the full
+internal nodes on its way down, so that the parent of the leaf always has room for one more
+child. The leaf takes as many keys of the run as fit in it and in at most one new sibling.
+Nodes are updated in place and a split keeps the left half in the page of the node, so the
+sibling chain only changes at the split leaf. On error, the runs inserted so far stay.
+*/
+func (tree *BTree) InsertBatch(sortedKVs []KV) (err error) {
+	defer recoverInvariant(&err)
+	for i, kv := range sortedKVs {
+		if i > 0 && bytes.Compare(sortedKVs[i-1].Key, kv.Key) >= 0 {
+			return ErrUnsortedBatch
+		}
+		if len(kv.Key) > maxKeyLen {
+			return fmt.Errorf("%w: key of %d bytes", ErrNodeFull, len(kv.Key))
+		}
+		if kvEntryLen(kv) > pageSize-dataOffset {
+			return fmt.Errorf("%w: KV pair of %d bytes", ErrNodeFull, keyOffset+len(kv.Key)+len(kv.Val))
+		}
+	}
+	if len(sortedKVs) == 0 {
+		return nil
+	}
+	if tree.rootPtr == nilPtr {
+		tree.rootPtr = tree.build(sortedKVs)
+		return nil
+	}
+	for len(sortedKVs) > 0 {
+		n, err := tree.insertRun(sortedKVs)
+		if err != nil {
+			return err
+		}
+		sortedKVs = sortedKVs[n:]
+	}
+	return nil
+}
+
+// Insert the run of kvs landing in the leaf of kvs[0] and return how many of them were taken.
+func (tree *BTree) insertRun(kvs []KV) (int, error) {
+	root, err := tree.loadNode(tree.rootPtr)
+	if err != nil {
+		return 0, err
+	}
+	if root.getType() == internal && root.isFull() {
+		// the tree grows by one level, the full root is split as the only child of a new one
+		root = newInternalNode([]child{{ptr: tree.rootPtr}})
+		tree.rootPtr = tree.new(root)
+	}
+	splitPtr, sep, n, err := tree.insert(tree.rootPtr, root, kvs, nil)
+	if err != nil {
+		return 0, err
+	}
+	if splitPtr != nilPtr {
+		tree.rootPtr = tree.new(newInternalNode([]child{{ptr: tree.rootPtr}, {ptr: splitPtr, sep: sep}}))
+	}
+	return n, nil
+}
+
+/*
+Insert the run of kvs into the subtree of the node at ptr, whose keys are below hi (nil for no
+bound). An internal node must have room for one more child. If the node is a leaf and splits,
+its right half is written to a new page, which is returned with the separator in front of it.
+*/
+func (tree *BTree) insert(ptr uint64, node BTreeNode, kvs []KV, hi []byte) (splitPtr uint64, sep []byte, n int, err error) {
+	if node.getType() == leaf {
+		splitPtr, sep, n = tree.insertLeaf(ptr, node, kvs, hi)
+		return splitPtr, sep, n, nil
+	}
+
+	children := node.getChildren()
+	idx := int(node.searchChild(kvs[0].Key))
+	childNode, err := tree.loadNode(children[idx].ptr)
+	if err != nil {
+		return nilPtr, nil, 0, err
+	}
+	if childNode.getType() == internal && childNode.isFull() {
+		// split on the way down, the left half stays in the page of the child
+		left, right := splitChildren(childNode.getChildren())
+		leftNode, rightNode := newInternalNode(left), newInternalNode(right)
+		tree.set(children[idx].ptr, leftNode)
+		children = insertChild(children, idx+1, child{ptr: tree.new(rightNode), sep: right[0].sep})
+		childNode = leftNode
+		if bytes.Compare(kvs[0].Key, right[0].sep) >= 0 {
+			childNode = rightNode
+			idx++
+		}
+	}
+
+	childHi := hi
+	if idx+1 < len(children) {
+		childHi = children[idx+1].sep
+	}
+	childSplitPtr, childSep, n, err := tree.insert(children[idx].ptr, childNode, kvs, childHi)
+	if err != nil {
+		return nilPtr, nil, 0, err
+	}
+	if childSplitPtr != nilPtr {
+		children = insertChild(children, idx+1, child{ptr: childSplitPtr, sep: childSep})
+	}
+	tree.set(ptr, newInternalNode(children))
+	return nilPtr, nil, n, nil
+}
+
+/*
+Merge the run of kvs below hi into the leaf at ptr, taking as many keys as fit in the leaf
+and one new sibling at most, split evenly. If not even the first key fits, the leaf is split
+at it without taking any key, so that the next run finds room.
+*/
+func (tree *BTree) insertLeaf(ptr uint64, node BTreeNode, kvs []KV, hi []byte) (splitPtr uint64, sep []byte, n int) {
+	pairs := node.getKVs()
+	// the run ends at hi, and at two leaves worth of bytes long before the end of a big batch
+	size, end := 0, 0
+	for end < len(kvs) && (hi == nil || bytes.Compare(kvs[end].Key, hi) < 0) && size <= 2*(pageSize-dataOffset) {
+		size += kvEntryLen(kvs[end])
+		end++
+	}
+	n = sort.Search(end, func(i int) bool {
+		return splitAt(mergeKVs(pairs, kvs[:i+1])) < 0
+	})
+
+	merged := pairs
+	if n > 0 {
+		merged = mergeKVs(pairs, kvs[:n])
+	}
+	at := splitAt(merged)
+	if n == 0 {
+		// the key lands between pairs it fits with on neither side
+		at = sort.Search(len(pairs), func(i int) bool { return bytes.Compare(pairs[i].Key, kvs[0].Key) >= 0 })
+	}
+	if at == 0 {
+		leaf := newLeaf(merged)
+		leaf.setNext(node.getNext())
+		tree.set(ptr, leaf)
+		return nilPtr, nil, n
+	}
+	left, right := newLeaf(merged[:at]), newLeaf(merged[at:])
+	right.setNext(node.getNext())
+	splitPtr = tree.new(right)
+	left.setNext(splitPtr)
+	tree.set(ptr, left)
+	return splitPtr, shortestSeparator(merged[at-1].Key, merged[at].Key), n
+}
+
+// the byte length a KV pair takes in a leaf
+func kvEntryLen(kv KV) int {
+	return kvOffsetLen + keyOffset + len(kv.Key) + len(kv.Val)
+}
+
+/*
+Where to split sorted KV pairs into two leaves of about the same byte size: 0 if they fit in
+a single leaf, -1 if they do not fit in two either. Splitting in the middle rather than
+filling the first leaf leaves room in both for the inserts to come.
+*/
+func splitAt(sortedKVs []KV) int {
+	total := 0
+	for _, kv := range sortedKVs {
+		total += kvEntryLen(kv)
+	}
+	if total <= pageSize-dataOffset {
+		return 0
+	}
+	at, best, left := -1, 0, 0
+	for i := 1; i < len(sortedKVs); i++ {
+		left += kvEntryLen(sortedKVs[i-1])
+		if larger := max(left, total-left); larger <= pageSize-dataOffset && (at < 0 || larger < best) {
+			at, best = i, larger
+		}
+	}
+	return at
+}
+
+// a leaf holding sorted KV pairs that fit in it
+func newLeaf(sortedKVs []KV) BTreeNode {
+	node := newNode(leaf)
+	for _, kv := range sortedKVs {
+		if err := node.appendKV(kv.Key, kv.Val); err != nil {
+			panic(err)
+		}
+	}
+	return node
+}
+
+// merge 2 sorted KV slices, the value in newKVs wins on equal keys
+func mergeKVs(oldKVs []KV, newKVs []KV) []KV {
+	merged := make([]KV, 0, len(oldKVs)+len(newKVs))
+	i, j := 0, 0
+	for i < len(oldKVs) && j < len(newKVs) {
+		switch cmp := bytes.Compare(oldKVs[i].Key, newKVs[j].Key); {
+		case cmp < 0:
+			merged = append(merged, oldKVs[i])
+			i++
+		case cmp > 0:
+			merged = append(merged, newKVs[j])
+			j++
+		default:
+			merged = append(merged, newKVs[j])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, oldKVs[i:]...)
+	return append(merged, newKVs[j:]...)
+}
+
+func (node BTreeNode) getKVs() []KV {
+	kvs := make([]KV, node.getCount())
+	for i := range kvs {
+		kvs[i].Key, kvs[i].Val = node.getKV(uint16(i))
+	}
+	return kvs
+}
+
+// a child pointer of an internal node with its separator
+type child struct {
+	ptr uint64
+	sep []byte
+}
+
+// the separators are copied, so that they outlive an update of the page in place
+func (node BTreeNode) getChildren() []child {
+	children := make([]child, node.getCount())
+	for i := range children {
+		sep := append([]byte{}, node.getSeparator(uint16(i))...)
+		children[i] = child{ptr: node.getChildPtr(uint16(i)), sep: sep}
+	}
+	return children
+}
+
+func insertChild(children []child, idx int, c child) []child {
+	children = append(children, child{})
+	copy(children[idx+1:], children[idx:])
+	children[idx] = c
+	return children
+}
+
+// the byte length an entry of a child takes in an internal node
+func childEntryLen(sep []byte) int {
+	return childPtrLen + kvOffsetLen + keyLenLen + len(sep)
+}
+
+// whether the node may have no room left for one more child (see maxKeyLen)
+func (node BTreeNode) isFull() bool {
+	return int(node.getSize())+childEntryLen(make([]byte, maxKeyLen)) > pageSize
+}
+
+// split the children of a full node in two halves of about the same byte size
+func splitChildren(children []child) ([]child, []child) {
+	total := 0
+	for _, c := range children {
+		total += childEntryLen(c.sep)
+	}
+	size, mid := 0, 0
+	for size < total/2 {
+		size += childEntryLen(children[mid].sep)
+		mid++
+	}
+	return children[:mid], children[mid:]
+}
+
+// an internal node holding the children, the 1st separator is left empty
+func newInternalNode(children []child) BTreeNode {
+	node := newNode(internal)
+	for i, c := range children {
+		sep := c.sep
+		if i == 0 {
+			sep = nil
+		}
+		if err := node.appendChild(c.ptr, sep); err != nil {
+			panic(err)
+		}
+	}
+	return node
+}
+
+/*
+Fill leaves with sorted KV pairs in order until ErrNodeFull. seps[i] is the separator between
+the i-th leaf and its left neighbour, the 1st one is empty.
+*/
+func packLeaves(sortedKVs []KV) ([]BTreeNode, [][]byte) {
+	leaves := []BTreeNode{newNode(leaf)}
+	seps := [][]byte{nil}
+	for i, kv := range sortedKVs {
+		if err := leaves[len(leaves)-1].appendKV(kv.Key, kv.Val); err != nil {
+			leaves = append(leaves, newNode(leaf))
+			leaves[len(leaves)-1].appendKV(kv.Key, kv.Val)
+			seps = append(seps, shortestSeparator(sortedKVs[i-1].Key, kv.Key))
+		}
+	}
+	return leaves, seps
+}
+
+/*
+Build a tree bottom-up from sorted KV pairs and return the root pointer. Pages of a level are
+handed to new from right to left, so that each leaf knows the pointer of its right sibling
+before it is stored.
+seps[i] is the separator between the i-th node of a level and its left neighbour. A node of
+an upper level inherits the separator of its 1st child, which is also the separator between
+the subtree of that node and the subtree on its left. The 1st separator of a level is empty.
+*/
+func (tree *BTree) build(sortedKVs []KV) uint64 {
+	leaves, seps := packLeaves(sortedKVs)
+	ptrs := make([]uint64, len(leaves))
+	next := nilPtr
+	for i := len(leaves) - 1; i >= 0; i-- {
+		leaves[i].setNext(next)
+		ptrs[i] = tree.new(leaves[i])
+		next = ptrs[i]
+	}
+
+	for len(ptrs) > 1 {
+		nodes := []BTreeNode{newNode(internal)}
+		nodeSeps := [][]byte{nil}
+		for i, ptr := range ptrs {
+			sep := seps[i]
+			if nodes[len(nodes)-1].getCount() == 0 {
+				sep = nil
+			}
+			if err := nodes[len(nodes)-1].appendChild(ptr, sep); err != nil {
+				nodes = append(nodes, newNode(internal))
+				nodes[len(nodes)-1].appendChild(ptr, nil)
+				nodeSeps = append(nodeSeps, seps[i])
+			}
+		}
+		ptrs = make([]uint64, len(nodes))
+		for i := len(nodes) - 1; i >= 0; i-- {
+			ptrs[i] = tree.new(nodes[i])
+		}
+		seps = nodeSeps
+	}
+	return ptrs[0]
+}
+
+// Look up the value of key by descending from the root along the separators.
+func (tree *BTree) Get(key []byte) (val []byte, ok bool, err error) {
+	defer recoverInvariant(&err)
+	ptr := tree.rootPtr
+	for ptr != nilPtr {
+		node, err := tree.loadNode(ptr)
+		if err != nil {
+			return nil, false, err
+		}
+		if node.getType() == internal {
+			ptr = node.getChildPtr(node.searchChild(key))
+			continue
+		}
+		lo, hi := uint16(0), node.getCount()
+		for lo < hi {
+			mid := lo + (hi-lo)/2
+			midKey, midVal := node.getKV(mid)
+			switch cmp := bytes.Compare(midKey, key); {
+			case cmp < 0:
+				lo = mid + 1
+			case cmp > 0:
+				hi = mid
+			default:
+				return midVal, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	return nil, false, nil
+}
+
+func newNode(type_ BTreeNodeType) BTreeNode {
+	node := BTreeNode(make([]byte, pageSize))
+	node.setType(type_)
+	node.setSize(headerLen)
+	return node
+}
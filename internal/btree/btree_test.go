@@ -1,10 +1,14 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"kv/test"
 	"math"
 	"math/rand"
+	"runtime"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -93,8 +97,7 @@ func TestCheckIdx(t *testing.T) {
 }
 
 func TestGetData(t *testing.T) {
-	size := uint16(20)
-	dataOffset := uint16(8)
+	size := uint16(28)
 	node := getNode(internal, 0, size)
 	assert.Equal(
 		t,
@@ -141,7 +144,7 @@ func TestGetKV(t *testing.T) {
 	binary.LittleEndian.PutUint16(kvOffsets[1*kvOffsetLen:], uint16(len(kvs[0])))
 	binary.LittleEndian.PutUint16(kvOffsets[2*kvOffsetLen:], uint16(len(kvs[0]) + len(kvs[1])))
 
-	header := BTreeNode(make([]byte, 8))
+	header := BTreeNode(make([]byte, headerLen))
 	header.setType(leaf)
 	header.setCount(kvPairsNum)
 	header.setSize(size)
@@ -159,3 +162,558 @@ func TestGetKV(t *testing.T) {
 		assert.Equal(t, expectedVal, actualVal)
 	}
 }
+
+// write header fields directly to bypass the bounds checks of the setters
+func getRawNode(type_ BTreeNodeType, count uint16, size uint16) BTreeNode {
+	node := BTreeNode(getSliceWithRandomIntegers(pageSize))
+	binary.LittleEndian.PutUint16(node[typeOffset:], uint16(type_))
+	binary.LittleEndian.PutUint16(node[countOffset:], count)
+	binary.LittleEndian.PutUint16(node[sizeOffset:], size)
+	return node
+}
+
+func TestCheckHeader(t *testing.T) {
+	assert.NotPanics(t, func() { getNode(internal, 2, dataOffset+2*(childPtrLen+kvOffsetLen)).checkHeader() })
+	assert.NotPanics(t, func() { getNode(leaf, 0, headerLen).checkHeader() })
+
+	assert.PanicsWithValue(
+		t,
+		fmt.Sprintf(panicUnknownTypeMsg, 7),
+		func() { getRawNode(BTreeNodeType(7), 0, headerLen).checkHeader() },
+	)
+	assert.Panics(t, func() { getRawNode(leaf, 0, headerLen-1).checkHeader() })
+	assert.Panics(t, func() { getRawNode(leaf, 0, pageSize+1).checkHeader() })
+	// 3 child pointers do not fit in 16 bytes of data
+	assert.Panics(t, func() { getRawNode(internal, 3, dataOffset+16).checkHeader() })
+	assert.Panics(t, func() { BTreeNode(make([]byte, 4)).checkHeader() })
+}
+
+func TestLoadNode(t *testing.T) {
+	pages := map[uint64][]byte{
+		1: getNode(leaf, 0, headerLen),
+		2: getRawNode(internal, 100, 16),
+	}
+	tree := &BTree{get: func(ptr uint64) []byte { return pages[ptr] }}
+
+	node, err := tree.loadNode(1)
+	assert.NoError(t, err)
+	assert.Equal(t, BTreeNode(pages[1]), node)
+
+	if panicOnInvariant {
+		assert.Panics(t, func() { tree.loadNode(2) })
+		return
+	}
+	node, err = tree.loadNode(2)
+	assert.ErrorIs(t, err, ErrCorruption)
+	assert.Nil(t, node)
+	_, err = tree.loadNode(3)
+	assert.ErrorIs(t, err, ErrCorruption)
+}
+
+func TestGetSliceOutOfBound(t *testing.T) {
+	slice := make([]byte, 10)
+	assert.PanicsWithValue(
+		t,
+		fmt.Sprintf(panicSliceMsg, 8, 12, 10),
+		func() { getSlice(slice, 8, 4) },
+	)
+	// offset+len would wrap around uint16
+	assert.Panics(t, func() { getSlice(slice, math.MaxUint16, 2) })
+}
+
+func TestSetBounds(t *testing.T) {
+	node := getNode(internal, 0, headerLen)
+	assert.Panics(t, func() { node.setSize(pageSize + 1) })
+	maxCount := uint16((pageSize - dataOffset) / getEntryLen(internal))
+	assert.NotPanics(t, func() { node.setCount(maxCount) })
+	assert.Panics(t, func() { node.setCount(maxCount + 1) })
+
+	node.setCount(2)
+	node.setSize(dataOffset + childPtrLen)
+	// the 2nd child pointer lies beyond the size
+	assert.Panics(t, func() { node.setChildPtr(1, 1) })
+	assert.Panics(t, func() { node.getChildPtr(1) })
+}
+
+func TestAppendChild(t *testing.T) {
+	node := getNode(internal, 0, headerLen)
+	ptrs, seps := []uint64{}, [][]byte{}
+	for {
+		ptr := uint64(rand.Int63())
+		sep := getSliceWithRandomIntegers(uint16(rand.Intn(16)))
+		if err := node.appendChild(ptr, sep); err != nil {
+			assert.ErrorIs(t, err, ErrNodeFull)
+			break
+		}
+		ptrs, seps = append(ptrs, ptr), append(seps, sep)
+	}
+	assert.Equal(t, uint16(len(ptrs)), node.getCount())
+	assert.LessOrEqual(t, node.getSize(), uint16(pageSize))
+	assert.NotPanics(t, node.checkHeader)
+	for i := range ptrs {
+		assert.Equal(t, ptrs[i], node.getChildPtr(uint16(i)))
+		assert.Equal(t, seps[i], node.getSeparator(uint16(i)))
+	}
+
+	// with empty separators each child takes a pointer, an offset and a key length
+	node = getNode(internal, 0, headerLen)
+	for node.appendChild(1, nil) == nil {
+	}
+	assert.Equal(t, uint16((pageSize-dataOffset)/(childPtrLen+kvOffsetLen+keyLenLen)), node.getCount())
+}
+
+func TestSearchChild(t *testing.T) {
+	node := getNode(internal, 0, headerLen)
+	for i, sep := range []string{"", "b", "d", "f"} {
+		node.appendChild(uint64(i), []byte(sep))
+	}
+	for key, expected := range map[string]uint16{
+		"": 0, "a": 0, "b": 1, "c": 1, "d": 2, "e": 2, "f": 3, "z": 3,
+	} {
+		assert.Equal(t, expected, node.searchChild([]byte(key)), key)
+	}
+}
+
+func TestAppendKV(t *testing.T) {
+	node := getNode(leaf, 0, headerLen)
+	keys, vals := [][]byte{}, [][]byte{}
+	for {
+		key := getSliceWithRandomIntegers(uint16(rand.Intn(64)))
+		val := getSliceWithRandomIntegers(uint16(rand.Intn(256)))
+		if err := node.appendKV(key, val); err != nil {
+			assert.ErrorIs(t, err, ErrNodeFull)
+			break
+		}
+		keys, vals = append(keys, key), append(vals, val)
+	}
+	assert.Equal(t, uint16(len(keys)), node.getCount())
+	assert.LessOrEqual(t, node.getSize(), uint16(pageSize))
+	for i := range keys {
+		key, val := node.getKV(uint16(i))
+		assert.Equal(t, keys[i], key)
+		assert.Equal(t, vals[i], val)
+	}
+
+	size := node.getSize()
+	assert.ErrorIs(t, node.appendKV(make([]byte, math.MaxUint16+1), nil), ErrNodeFull)
+	assert.Equal(t, size, node.getSize())
+}
+
+/*
+Whatever sequence of keys and values is appended, a leaf never outgrows its page, stays
+consistent with checkHeader and gives back exactly what was appended.
+*/
+func FuzzAppendKV(f *testing.F) {
+	f.Add([]byte("key"), []byte("val"), uint8(1))
+	f.Add([]byte{}, []byte{}, uint8(255))
+	f.Add(make([]byte, 1000), make([]byte, 3000), uint8(3))
+	f.Fuzz(func(t *testing.T, key []byte, val []byte, times uint8) {
+		node := getNode(leaf, 0, headerLen)
+		appended := uint16(0)
+		for i := uint8(0); i < times; i++ {
+			if err := node.appendKV(key, val); err != nil {
+				assert.ErrorIs(t, err, ErrNodeFull)
+				break
+			}
+			appended++
+		}
+		assert.Equal(t, appended, node.getCount())
+		assert.LessOrEqual(t, node.getSize(), uint16(pageSize))
+		assert.NotPanics(t, node.checkHeader)
+		for i := uint16(0); i < appended; i++ {
+			actualKey, actualVal := node.getKV(i)
+			assert.Equal(t, len(key), len(actualKey))
+			assert.Equal(t, len(val), len(actualVal))
+		}
+	})
+}
+
+/*
+Arbitrary page content must only ever trip the explicit bounds checks of the accessors,
+never a runtime out-of-range panic, i.e. no offset arithmetic can read outside the page.
+*/
+func FuzzCorruptedNode(f *testing.F) {
+	f.Add([]byte(getNode(leaf, 0, headerLen)), uint16(0))
+	f.Add([]byte(getRawNode(leaf, 3, 100)), uint16(2))
+	f.Add([]byte(getRawNode(internal, 5, 48)), uint16(4))
+	f.Fuzz(func(t *testing.T, page []byte, idx uint16) {
+		defer func() {
+			r := recover()
+			_, isRuntimeErr := r.(runtime.Error)
+			assert.False(t, isRuntimeErr, "%v", r)
+		}()
+		node := BTreeNode(page)
+		node.checkHeader()
+		if node.getType() == leaf {
+			node.getKV(idx)
+		} else {
+			node.getChildPtr(idx)
+			node.getSeparator(idx)
+		}
+	})
+}
+
+/*
+Build a 2-level tree in memory: a root with leavesNum leaves, each holding kvsPerLeaf KV
+pairs, sibling linked from left to right. Page pointers start at 1 since 0 is nilPtr.
+*/
+func getTwoLevelTree(leavesNum int, kvsPerLeaf int) (*BTree, map[uint64]BTreeNode, [][]byte) {
+	pages := map[uint64]BTreeNode{}
+	keys := [][]byte{}
+	root := newNode(internal)
+	pages[1] = root
+	for i := 0; i < leavesNum; i++ {
+		ptr := uint64(i + 2)
+		node := newNode(leaf)
+		for j := 0; j < kvsPerLeaf; j++ {
+			key := []byte(fmt.Sprintf("key-%04d", i*kvsPerLeaf+j))
+			node.appendKV(key, key)
+			keys = append(keys, key)
+		}
+		if i+1 < leavesNum {
+			node.setNext(ptr + 1)
+		}
+		sep := []byte(nil)
+		if i > 0 {
+			sep = keys[i*kvsPerLeaf]
+		}
+		root.appendChild(ptr, sep)
+		pages[ptr] = node
+	}
+	tree := &BTree{rootPtr: 1, get: func(ptr uint64) []byte { return pages[ptr] }}
+	return tree, pages, keys
+}
+
+func TestSetGetNext(t *testing.T) {
+	node := newNode(leaf)
+	assert.Equal(t, nilPtr, node.getNext())
+	node.setNext(42)
+	assert.Equal(t, uint64(42), node.getNext())
+	assert.Panics(t, func() { newNode(internal).getNext() })
+}
+
+func TestLevelOrder(t *testing.T) {
+	tree, _, _ := getTwoLevelTree(3, 2)
+	levels := [][]uint64{}
+	err := tree.levelOrder(func(level int, ptrs []uint64, nodes []BTreeNode) error {
+		assert.Equal(t, len(levels), level)
+		levels = append(levels, ptrs)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]uint64{{1}, {2, 3, 4}}, levels)
+
+	assert.NoError(t, (&BTree{}).levelOrder(func(int, []uint64, []BTreeNode) error {
+		t.Fatal("empty tree has no levels")
+		return nil
+	}))
+}
+
+func TestValidateSiblings(t *testing.T) {
+	tree, pages, _ := getTwoLevelTree(3, 2)
+	assert.NoError(t, tree.ValidateSiblings())
+
+	pages[3].setNext(2)
+	assert.ErrorIs(t, tree.ValidateSiblings(), ErrCorruption)
+	pages[3].setNext(4)
+	pages[4].setNext(2)
+	assert.ErrorIs(t, tree.ValidateSiblings(), ErrCorruption)
+	pages[4].setNext(nilPtr)
+	assert.NoError(t, tree.ValidateSiblings())
+
+	// a leaf hanging one level above the others
+	pages[1].appendChild(5, []byte("x"))
+	pages[5] = newNode(internal)
+	pages[5].appendChild(6, nil)
+	pages[6] = newNode(leaf)
+	pages[4].setNext(6)
+	assert.ErrorIs(t, tree.ValidateSiblings(), ErrCorruption)
+}
+
+func TestScan(t *testing.T) {
+	tree, _, expectedKeys := getTwoLevelTree(4, 5)
+	keys := [][]byte{}
+	err := tree.scan(func(key []byte, val []byte) bool {
+		assert.Equal(t, key, val)
+		keys = append(keys, key)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, expectedKeys, keys)
+
+	scanned := 0
+	err = tree.scan(func([]byte, []byte) bool {
+		scanned++
+		return scanned < 7
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, scanned)
+
+	assert.NoError(t, (&BTree{}).scan(func([]byte, []byte) bool { return true }))
+}
+
+func TestFirstLastKey(t *testing.T) {
+	tree, _, keys := getTwoLevelTree(3, 4)
+	firstKey, err := tree.FirstKey()
+	assert.NoError(t, err)
+	assert.Equal(t, keys[0], firstKey)
+	lastKey, err := tree.LastKey()
+	assert.NoError(t, err)
+	assert.Equal(t, keys[len(keys)-1], lastKey)
+
+	pages := map[uint64]BTreeNode{1: newNode(leaf)}
+	tree = &BTree{rootPtr: 1, get: func(ptr uint64) []byte { return pages[ptr] }}
+	firstKey, err = tree.FirstKey()
+	assert.NoError(t, err)
+	assert.Nil(t, firstKey)
+	pages[1].appendKV([]byte("only"), nil)
+	firstKey, _ = tree.FirstKey()
+	lastKey, _ = tree.LastKey()
+	assert.Equal(t, []byte("only"), firstKey)
+	assert.Equal(t, []byte("only"), lastKey)
+
+	lastKey, err = (&BTree{}).LastKey()
+	assert.NoError(t, err)
+	assert.Nil(t, lastKey)
+}
+
+func TestStats(t *testing.T) {
+	tree, _, _ := getTwoLevelTree(3, 4)
+	stats, err := tree.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, BTreeStats{Height: 2, PageCount: 4, LeafCount: 3, KVCount: 12}, stats)
+
+	height, err := tree.Height()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, height)
+	pageCount, err := tree.PageCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, pageCount)
+
+	stats, err = (&BTree{}).Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, BTreeStats{}, stats)
+}
+
+// an in-memory pager, page pointers start at 1 since 0 is nilPtr
+func getMemTree() (*BTree, map[uint64]BTreeNode) {
+	pages := map[uint64]BTreeNode{}
+	lastPtr := nilPtr
+	return &BTree{
+		get: func(ptr uint64) []byte { return pages[ptr] },
+		new: func(node []byte) uint64 {
+			lastPtr++
+			pages[lastPtr] = node
+			return lastPtr
+		},
+		set: func(ptr uint64, node []byte) { pages[ptr] = node },
+		del: func(ptr uint64) { delete(pages, ptr) },
+	}, pages
+}
+
+func getSortedKVs(keys []string, val string) []KV {
+	sort.Strings(keys)
+	kvs := make([]KV, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, KV{Key: []byte(key), Val: []byte(val)})
+	}
+	return kvs
+}
+
+func scanAll(t *testing.T, tree *BTree) []KV {
+	kvs := []KV{}
+	assert.NoError(t, tree.scan(func(key []byte, val []byte) bool {
+		kvs = append(kvs, KV{Key: key, Val: val})
+		return true
+	}))
+	return kvs
+}
+
+func TestInsertBatch(t *testing.T) {
+	tree, pages := getMemTree()
+	keys := test.RandStrs(20, 5000)
+	kvs := getSortedKVs(keys, "old")
+	assert.NoError(t, tree.InsertBatch(kvs))
+	assert.NoError(t, tree.ValidateSiblings())
+	assert.Equal(t, kvs, scanAll(t, tree))
+
+	stats, err := tree.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 5000, stats.KVCount)
+	assert.GreaterOrEqual(t, stats.Height, 2)
+	assert.Equal(t, len(pages), stats.PageCount)
+
+	// half of the keys are updated, the other half are new
+	newKeys := append(test.RandStrs(21, 2500), keys[:2500]...)
+	isNew := map[string]bool{}
+	for _, key := range newKeys {
+		isNew[key] = true
+	}
+	assert.NoError(t, tree.InsertBatch(getSortedKVs(newKeys, "new")))
+	assert.NoError(t, tree.ValidateSiblings())
+	merged := scanAll(t, tree)
+	assert.Equal(t, 7500, len(merged))
+	for i, kv := range merged {
+		if i > 0 {
+			assert.Less(t, string(merged[i-1].Key), string(kv.Key))
+		}
+		if isNew[string(kv.Key)] {
+			assert.Equal(t, "new", string(kv.Val))
+		} else {
+			assert.Equal(t, "old", string(kv.Val))
+		}
+	}
+	pageCount, _ := tree.PageCount()
+	assert.Equal(t, len(pages), pageCount)
+}
+
+func TestGet(t *testing.T) {
+	tree, _ := getMemTree()
+	val, ok, err := tree.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, val)
+
+	// long shared prefixes make separators much shorter than the keys
+	keys := []string{}
+	for _, str := range test.RandStrs(30, 10000) {
+		keys = append(keys, "common-prefix-"+str)
+	}
+	kvs := getSortedKVs(keys, "")
+	for i := range kvs {
+		kvs[i].Val = append([]byte("val-"), kvs[i].Key...)
+	}
+	assert.NoError(t, tree.InsertBatch(kvs))
+	height, _ := tree.Height()
+	assert.GreaterOrEqual(t, height, 2)
+	for _, kv := range kvs {
+		val, ok, err := tree.Get(kv.Key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, kv.Val, val)
+	}
+	for _, key := range []string{"", "common-prefix-", "zzz", keys[0] + "0"} {
+		_, ok, err := tree.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestInsertBatchInvalid(t *testing.T) {
+	tree, pages := getMemTree()
+	assert.NoError(t, tree.InsertBatch(nil))
+	assert.Equal(t, nilPtr, tree.rootPtr)
+
+	unsorted := []KV{{Key: []byte("b")}, {Key: []byte("a")}}
+	assert.ErrorIs(t, tree.InsertBatch(unsorted), ErrUnsortedBatch)
+	duplicated := []KV{{Key: []byte("a")}, {Key: []byte("a")}}
+	assert.ErrorIs(t, tree.InsertBatch(duplicated), ErrUnsortedBatch)
+	tooLarge := []KV{{Key: []byte("a"), Val: make([]byte, pageSize)}}
+	assert.ErrorIs(t, tree.InsertBatch(tooLarge), ErrNodeFull)
+	// a key that fits in a leaf but whose separators would not fit twice in an internal node
+	tooLong := []KV{{Key: make([]byte, maxKeyLen+1)}}
+	assert.ErrorIs(t, tree.InsertBatch(tooLong), ErrNodeFull)
+	assert.Empty(t, pages)
+}
+
+func TestInsertBatchLongKeys(t *testing.T) {
+	// keys sharing all but their last byte give separators as long as the keys
+	for _, keyLen := range []int{maxKeyLen, 4074} {
+		tree, _ := getMemTree()
+		kvs := []KV{}
+		for i := 0; i < 20; i++ {
+			kvs = append(kvs, KV{Key: append(bytes.Repeat([]byte("a"), keyLen-2), fmt.Sprintf("%02d", i)...), Val: []byte{}})
+		}
+		if keyLen > maxKeyLen {
+			// these fit in a leaf, one per leaf, but the internal levels would never shrink
+			assert.ErrorIs(t, tree.InsertBatch(kvs[:3]), ErrNodeFull)
+			assert.Equal(t, nilPtr, tree.rootPtr)
+			continue
+		}
+		assert.NoError(t, tree.InsertBatch(kvs))
+		assert.NoError(t, tree.ValidateSiblings())
+		assert.Equal(t, kvs, scanAll(t, tree))
+
+		// one by one, backwards, the internal nodes split on the way down
+		tree, _ = getMemTree()
+		for i := len(kvs) - 1; i >= 0; i-- {
+			assert.NoError(t, tree.InsertBatch(kvs[i:i+1]))
+		}
+		assert.NoError(t, tree.ValidateSiblings())
+		assert.Equal(t, kvs, scanAll(t, tree))
+		height, _ := tree.Height()
+		assert.GreaterOrEqual(t, height, 3)
+		for _, kv := range kvs {
+			_, ok, err := tree.Get(kv.Key)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	}
+}
+
+func TestInsertBatchRuns(t *testing.T) {
+	tree, pages := getMemTree()
+	expected := map[string]string{}
+	keys := test.RandStrs(10, 3000)
+	inserted := []string{}
+	// batches of random sizes, some overwriting a key inserted before
+	for len(keys) > 0 {
+		n := min(len(keys), 1+rand.Intn(50))
+		batch := append([]string{}, keys[:n]...)
+		if len(inserted) > 0 && n%2 == 0 {
+			batch = append(batch, inserted[rand.Intn(len(inserted))])
+		}
+		inserted = append(inserted, keys[:n]...)
+		kvs := getSortedKVs(batch, fmt.Sprintf("val-%d", len(keys)))
+		assert.NoError(t, tree.InsertBatch(kvs))
+		for _, kv := range kvs {
+			expected[string(kv.Key)] = string(kv.Val)
+		}
+		keys = keys[n:]
+	}
+	assert.NoError(t, tree.ValidateSiblings())
+	kvs := scanAll(t, tree)
+	assert.Equal(t, len(expected), len(kvs))
+	for i, kv := range kvs {
+		if i > 0 {
+			assert.Less(t, string(kvs[i-1].Key), string(kv.Key))
+		}
+		assert.Equal(t, expected[string(kv.Key)], string(kv.Val))
+	}
+	stats, err := tree.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, len(pages), stats.PageCount)
+	assert.GreaterOrEqual(t, stats.Height, 2)
+}
+
+func TestInsertBatchWritesOnePath(t *testing.T) {
+	tree, _ := getMemTree()
+	assert.NoError(t, tree.InsertBatch(getSortedKVs(test.RandStrs(200, 20000), "val")))
+	height, _ := tree.Height()
+	assert.GreaterOrEqual(t, height, 3)
+
+	reads, writes := 0, 0
+	get, new_, set := tree.get, tree.new, tree.set
+	tree.get = func(ptr uint64) []byte { reads++; return get(ptr) }
+	tree.new = func(node []byte) uint64 { writes++; return new_(node) }
+	tree.set = func(ptr uint64, node []byte) { writes++; set(ptr, node) }
+	assert.NoError(t, tree.InsertBatch([]KV{{Key: []byte("key"), Val: []byte("val")}}))
+	// a split leaf and a split node on every level at most
+	assert.LessOrEqual(t, reads, height)
+	assert.LessOrEqual(t, writes, 2*height+1)
+}
+
+func TestInsertBatchSplitsAtKey(t *testing.T) {
+	tree, _ := getMemTree()
+	big := func(key string) KV { return KV{Key: []byte(key), Val: make([]byte, 2500)} }
+	assert.NoError(t, tree.InsertBatch([]KV{{Key: []byte("a"), Val: make([]byte, 2000)}, {Key: []byte("c"), Val: make([]byte, 2000)}}))
+	// "b" fits with neither "a" nor "c", so the leaf is split in between first
+	assert.NoError(t, tree.InsertBatch([]KV{big("b")}))
+	assert.NoError(t, tree.InsertBatch([]KV{big("ba"), big("bb")}))
+	assert.NoError(t, tree.ValidateSiblings())
+	keys := []string{}
+	for _, kv := range scanAll(t, tree) {
+		keys = append(keys, string(kv.Key))
+	}
+	assert.Equal(t, []string{"a", "b", "ba", "bb", "c"}, keys)
+}
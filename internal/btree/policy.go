@@ -0,0 +1,24 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrCorruption = errors.New("btree: corrupted node")
+
+/*
+The byte-layout helpers panic as soon as a node breaks an invariant (type mismatch, index
+out of bound, offsets pointing outside the page). BTree operations defer recoverInvariant
+so that one bad page only fails the calling operation with ErrCorruption instead of crashing
+the whole process. Builds with the kvdebug tag keep the panics so that bugs surface right
+where they happen.
+*/
+func recoverInvariant(err *error) {
+	if panicOnInvariant {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w: %v", ErrCorruption, r)
+	}
+}
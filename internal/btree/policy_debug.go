@@ -0,0 +1,5 @@
+//go:build kvdebug
+
+package btree
+
+const panicOnInvariant = true
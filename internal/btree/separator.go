@@ -0,0 +1,24 @@
+package btree
+
+/*
+Internal nodes route keys with separators rather than full keys: for 2 adjacent subtrees
+whose keys are bounded by prev (the largest key on the left) and next (the smallest key on
+the right), any sep with prev < sep <= next routes every key correctly. The shortest such
+sep is the common prefix of prev and next plus the first byte of next that differs, e.g.
+("apple", "apricot") gives "apr" and ("app", "apple") gives "appl".
+Since prev < sep, keys of the right subtree never go left, and since sep <= next, no key
+of the right subtree is sent elsewhere.
+*/
+func shortestSeparator(prev []byte, next []byte) []byte {
+	prefixLen := 0
+	for prefixLen < len(prev) && prefixLen < len(next) && prev[prefixLen] == next[prefixLen] {
+		prefixLen++
+	}
+	if prefixLen == len(next) || prefixLen < len(prev) && prev[prefixLen] > next[prefixLen] {
+		// next <= prev, there is no valid separator
+		panicUnorderedKeys(prev, next)
+	}
+	sep := make([]byte, prefixLen+1)
+	copy(sep, next)
+	return sep
+}
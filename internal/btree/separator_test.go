@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"kv/test"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortestSeparator(t *testing.T) {
+	cases := []struct {
+		prev, next, expected string
+	}{
+		{"apple", "apricot", "apr"},
+		{"app", "apple", "appl"},
+		{"", "a", "a"},
+		{"", "abc", "a"},
+		{"a", "b", "b"},
+		{"abc", "abd", "abd"},
+		{"abc", "abcd", "abcd"},
+		{"abcz", "abd", "abd"},
+		{"a\xff", "b", "b"},
+		{"a\x00", "a\x01", "a\x01"},
+		{"a", "a\x00", "a\x00"},
+	}
+	for _, c := range cases {
+		sep := shortestSeparator([]byte(c.prev), []byte(c.next))
+		assert.Equal(t, c.expected, string(sep), "(%q, %q)", c.prev, c.next)
+	}
+}
+
+func TestShortestSeparatorUnordered(t *testing.T) {
+	expectedMsg := fmt.Sprintf(panicUnorderedKeysMsg, []byte("b"), []byte("a"))
+	assert.PanicsWithValue(t, expectedMsg, func() { shortestSeparator([]byte("b"), []byte("a")) })
+	assert.Panics(t, func() { shortestSeparator([]byte("a"), []byte("a")) })
+	assert.Panics(t, func() { shortestSeparator([]byte("abc"), []byte("ab")) })
+}
+
+// every byte string shorter than maxLen
+func getAllShorterStrs(maxLen int) [][]byte {
+	strs := [][]byte{{}}
+	for start := 0; len(strs[len(strs)-1]) < maxLen-1; {
+		end := len(strs)
+		for _, str := range strs[start:end] {
+			for b := 0; b < 256; b++ {
+				strs = append(strs, append(append([]byte{}, str...), byte(b)))
+			}
+		}
+		start = end
+	}
+	return strs
+}
+
+/*
+For adjacent sorted keys, prev < sep <= next holds and no shorter byte string fits in between.
+Shorter strings are enumerated exhaustively, so keys are kept short.
+*/
+func TestShortestSeparatorAdjacentKeys(t *testing.T) {
+	keys := test.RandStrs(1, 40)
+	keys = append(keys, keys[0]+"a", keys[1]+keys[1], "")
+	sort.Strings(keys)
+	for i := 1; i < len(keys); i++ {
+		prev, next := []byte(keys[i-1]), []byte(keys[i])
+		sep := shortestSeparator(prev, next)
+		assert.Less(t, bytes.Compare(prev, sep), 0)
+		assert.LessOrEqual(t, bytes.Compare(sep, next), 0)
+		for _, shorter := range getAllShorterStrs(len(sep)) {
+			if bytes.Compare(prev, shorter) < 0 && bytes.Compare(shorter, next) <= 0 {
+				t.Errorf("%q fits between %q and %q", shorter, prev, next)
+			}
+		}
+	}
+}
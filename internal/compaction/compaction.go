@@ -0,0 +1,273 @@
+package compaction
+
+import (
+	"sort"
+)
+
+/*
+Leveled compaction. L0 holds the tables flushed from the memtable, their key ranges may
+overlap, so they are ordered by age. Every level below L0 holds a sorted run: tables with
+disjoint key ranges, in key order. The data of a level is newer than the data of the levels
+below it, so a lookup searches L0 newest first and then at most one table of every level.
+
+A compaction merges tables of a level with the tables of the next level they overlap and
+replaces all of them with new tables in the next level. L0 is compacted once it holds
+L0Trigger tables, every other level once it outgrows its target size, which is
+BaseLevelSize for L1 and LevelMultiplier times larger for every level further down. The
+last level is never compacted.
+
+Size-tiered compaction keeps everything in L0 instead, every table a sorted run of its own.
+Once L0 holds L0Trigger tables, a window of consecutive tables of similar size is merged
+into a single table that takes their place. Every byte is rewritten about once per size
+tier, far less often than under leveled compaction, at the cost of more tables to search.
+*/
+
+type Style int
+
+const (
+	Leveled Style = iota
+	SizeTiered
+)
+
+// a table joins the window of a size-tiered compaction if it is at most this many times the
+// size of the tables in the window before it
+const tieredSizeRatio = 1.2
+
+// a table as compaction sees it
+type Table struct {
+	Num  uint64
+	Size uint64
+	// the smallest and the largest key of the table, range tombstones included. If a range
+	// tombstone ends behind the last key, Largest is the exclusive end of it
+	Smallest string
+	Largest  string
+}
+
+func (t *Table) overlaps(smallest, largest string) bool {
+	return t.Smallest <= largest && smallest <= t.Largest
+}
+
+type Options struct {
+	Style Style
+	// the number of L0 tables that triggers a compaction
+	L0Trigger int
+	// the target byte size of L1, every level below is LevelMultiplier times larger
+	BaseLevelSize   uint64
+	LevelMultiplier int
+	// the byte size at which the outputs of a leveled compaction are cut, a size-tiered
+	// compaction writes a single table
+	TargetTableSize uint64
+	// the number of levels, L0 included
+	Levels int
+	// pick the table of a level overlapping the fewest bytes of the next level relative to its
+	// own size, instead of cycling through the level. The pick is then a function of the
+	// levels alone
+	MinOverlap bool
+}
+
+// the target byte size of a level below L0
+func (opts *Options) levelSize(level int) uint64 {
+	size := opts.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= uint64(opts.LevelMultiplier)
+	}
+	return size
+}
+
+// a compaction of tables of Level into Output, the next level or L0 again if size-tiered
+type Task struct {
+	Level  int
+	Output int
+	// the tables of Level, newest first for L0, and the tables of Level+1 they overlap, in
+	// key order
+	Upper []Table
+	Lower []Table
+	// no table older than the inputs overlaps their key range, so tombstones have nothing
+	// left to delete and can be dropped
+	Bottom bool
+}
+
+// Picker decides which tables to compact next.
+type Picker struct {
+	opts Options
+	// the largest key compacted last in every level, so that compactions cycle through a level
+	cursors []string
+}
+
+func NewPicker(opts Options) *Picker {
+	return &Picker{opts: opts, cursors: make([]string, opts.Levels)}
+}
+
+/*
+Pick the compaction of the level the furthest beyond its target, nil if no level is.
+levels[0] lists the L0 tables newest first, every other level lists its tables in key
+order. Tables of a level below L0 are compacted in turn, from the smallest key upwards.
+Compactions run concurrently, busy lists the numbers of the tables being compacted. A
+compaction never takes a busy table, so if the level the furthest beyond its target has
+none to offer, the next one is tried.
+*/
+func (p *Picker) Pick(levels [][]Table, busy map[uint64]bool) *Task {
+	task := p.pick(levels, busy)
+	if task != nil {
+		task.Bottom = bottom(levels, task)
+	}
+	return task
+}
+
+func (p *Picker) pick(levels [][]Table, busy map[uint64]bool) *Task {
+	if p.opts.Style == SizeTiered {
+		return p.pickTiered(levels[0], busy)
+	}
+	type score struct {
+		level int
+		score float64
+	}
+	scores := []score{}
+	for i := 0; i < len(levels) && i < p.opts.Levels-1; i++ {
+		var s float64
+		if i == 0 {
+			s = float64(len(levels[0])) / float64(p.opts.L0Trigger)
+		} else {
+			size := uint64(0)
+			for _, t := range levels[i] {
+				size += t.Size
+			}
+			s = float64(size) / float64(p.opts.levelSize(i))
+		}
+		if s >= 1 {
+			scores = append(scores, score{i, s})
+		}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+
+	for _, s := range scores {
+		if s.level == 0 {
+			if task := p.task(levels, 0, levels[0], busy); task != nil {
+				return task
+			}
+			continue
+		}
+		if p.opts.MinOverlap {
+			if task := p.minOverlapTask(levels, s.level, busy); task != nil {
+				return task
+			}
+			continue
+		}
+		level := levels[s.level]
+		i := 0
+		for i < len(level) && level[i].Smallest <= p.cursors[s.level] {
+			i++
+		}
+		for n := 0; n < len(level); n++ {
+			t := level[(i+n)%len(level)]
+			if task := p.task(levels, s.level, []Table{t}, busy); task != nil {
+				p.cursors[s.level] = t.Largest
+				return task
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Whether no table older than the inputs of the task overlaps their key range. These are the
+L0 tables behind the oldest input of L0 and the tables of the levels below the output. The
+other tables of the level and of the output are newer or lie outside the key range.
+*/
+func bottom(levels [][]Table, task *Task) bool {
+	inputs := append(append([]Table{}, task.Upper...), task.Lower...)
+	smallest, largest := inputs[0].Smallest, inputs[0].Largest
+	for _, t := range inputs {
+		smallest, largest = min(smallest, t.Smallest), max(largest, t.Largest)
+	}
+	older := [][]Table{}
+	if task.Level == 0 {
+		last := task.Upper[len(task.Upper)-1].Num
+		for i, t := range levels[0] {
+			if t.Num == last {
+				older = append(older, levels[0][i+1:])
+			}
+		}
+	}
+	older = append(older, levels[min(task.Output+1, len(levels)):]...)
+	for _, level := range older {
+		for _, t := range level {
+			if t.overlaps(smallest, largest) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// the compaction of the table of level overlapping the fewest bytes of the next level
+func (p *Picker) minOverlapTask(levels [][]Table, level int, busy map[uint64]bool) *Task {
+	var best *Task
+	var bestRatio float64
+	for _, t := range levels[level] {
+		task := p.task(levels, level, []Table{t}, busy)
+		if task == nil {
+			continue
+		}
+		overlap := uint64(0)
+		for _, lower := range task.Lower {
+			overlap += lower.Size
+		}
+		ratio := float64(overlap) / float64(max(t.Size, 1))
+		if best == nil || ratio < bestRatio {
+			best, bestRatio = task, ratio
+		}
+	}
+	return best
+}
+
+// the compaction of upper with the tables of the next level it overlaps, nil if any is busy
+func (p *Picker) task(levels [][]Table, level int, upper []Table, busy map[uint64]bool) *Task {
+	task := &Task{Level: level, Output: level + 1, Upper: upper}
+	smallest, largest := upper[0].Smallest, upper[0].Largest
+	for _, t := range upper {
+		if busy[t.Num] {
+			return nil
+		}
+		smallest, largest = min(smallest, t.Smallest), max(largest, t.Largest)
+	}
+	if level+1 < len(levels) {
+		for _, t := range levels[level+1] {
+			if !t.overlaps(smallest, largest) {
+				continue
+			}
+			if busy[t.Num] {
+				return nil
+			}
+			task.Lower = append(task.Lower, t)
+		}
+	}
+	return task
+}
+
+/*
+Pick the newest window of at least two consecutive L0 tables of similar size. If there is
+none, the newest tables are merged so that L0 falls below L0Trigger.
+*/
+func (p *Picker) pickTiered(l0 []Table, busy map[uint64]bool) *Task {
+	if len(l0) < max(2, p.opts.L0Trigger) {
+		return nil
+	}
+	// the merged window takes its place in L0, so one compaction runs at a time
+	for _, t := range l0 {
+		if busy[t.Num] {
+			return nil
+		}
+	}
+	for start := range l0 {
+		size, end := float64(l0[start].Size), start+1
+		for end < len(l0) && float64(l0[end].Size) <= size*tieredSizeRatio {
+			size += float64(l0[end].Size)
+			end++
+		}
+		if end-start >= 2 {
+			return &Task{Upper: l0[start:end]}
+		}
+	}
+	return &Task{Upper: l0[:min(len(l0), len(l0)-p.opts.L0Trigger+2)]}
+}
@@ -0,0 +1,141 @@
+package compaction
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testOptions = Options{L0Trigger: 4, BaseLevelSize: 100, LevelMultiplier: 10, TargetTableSize: 50, Levels: 4}
+
+func TestPickL0(t *testing.T) {
+	p := NewPicker(testOptions)
+	levels := [][]Table{
+		{{Num: 5, Smallest: "e", Largest: "f"}, {Num: 4, Smallest: "a", Largest: "c"}, {Num: 3, Smallest: "b", Largest: "d"}},
+		{{Num: 1, Size: 10, Smallest: "a", Largest: "b"}, {Num: 2, Size: 10, Smallest: "x", Largest: "z"}},
+	}
+	assert.Nil(t, p.Pick(levels, nil))
+
+	levels[0] = append([]Table{{Num: 6, Smallest: "c", Largest: "d"}}, levels[0]...)
+	task := p.Pick(levels, nil)
+	assert.Equal(t, 0, task.Level)
+	assert.Equal(t, levels[0], task.Upper)
+	// only the L1 tables overlapping [a, f]
+	assert.Equal(t, levels[1][:1], task.Lower)
+}
+
+func TestPickLevels(t *testing.T) {
+	p := NewPicker(testOptions)
+	levels := [][]Table{
+		{},
+		{{Num: 1, Size: 60, Smallest: "a", Largest: "c"}, {Num: 2, Size: 60, Smallest: "d", Largest: "f"}},
+		{{Num: 3, Size: 10, Smallest: "b", Largest: "e"}, {Num: 4, Size: 10, Smallest: "x", Largest: "z"}},
+		// the last level is never compacted
+		{{Num: 5, Size: 1 << 30, Smallest: "a", Largest: "z"}},
+	}
+	task := p.Pick(levels, nil)
+	assert.Equal(t, 1, task.Level)
+	assert.Equal(t, levels[1][:1], task.Upper)
+	assert.Equal(t, levels[2][:1], task.Lower)
+	// the next compaction of the level goes on behind the last one
+	task = p.Pick(levels, nil)
+	assert.Equal(t, levels[1][1:], task.Upper)
+	assert.Equal(t, levels[2][:1], task.Lower)
+	task = p.Pick(levels, nil)
+	assert.Equal(t, levels[1][:1], task.Upper)
+
+	// the level the furthest beyond its target goes first
+	levels[2][1].Size = 5000
+	task = p.Pick(levels, nil)
+	assert.Equal(t, 2, task.Level)
+	assert.Equal(t, levels[2][:1], task.Upper)
+	assert.Equal(t, levels[3], task.Lower)
+}
+
+func TestPickSizeTiered(t *testing.T) {
+	opts := testOptions
+	opts.Style = SizeTiered
+	p := NewPicker(opts)
+	// newest first
+	levels := [][]Table{{{Num: 9, Size: 10}, {Num: 8, Size: 100}, {Num: 7, Size: 100}, {Num: 6, Size: 110}}, {}}
+	task := p.Pick(levels, nil)
+	assert.Equal(t, 0, task.Level)
+	assert.Equal(t, 0, task.Output)
+	// the newest table is too small to join the others
+	assert.Equal(t, levels[0][1:], task.Upper)
+	assert.Empty(t, task.Lower)
+
+	// without tables of similar size the newest are merged
+	levels[0] = []Table{{Num: 9, Size: 10}, {Num: 8, Size: 100}, {Num: 7, Size: 1000}, {Num: 6, Size: 10000}}
+	assert.Equal(t, levels[0][:2], p.Pick(levels, nil).Upper)
+
+	assert.Nil(t, p.Pick([][]Table{levels[0][:3], {}}, nil))
+}
+
+func TestPickBusy(t *testing.T) {
+	p := NewPicker(testOptions)
+	levels := [][]Table{
+		{{Num: 9, Smallest: "a", Largest: "b"}, {Num: 8, Smallest: "a", Largest: "b"}, {Num: 7, Smallest: "a", Largest: "b"}, {Num: 6, Smallest: "a", Largest: "b"}},
+		{{Num: 1, Size: 60, Smallest: "a", Largest: "c"}, {Num: 2, Size: 60, Smallest: "d", Largest: "f"}, {Num: 3, Size: 60, Smallest: "g", Largest: "h"}},
+		{{Num: 4, Size: 10, Smallest: "b", Largest: "e"}},
+		{},
+	}
+	// L1 is the furthest beyond its target, its tables 1 and 4 of L2 are being compacted
+	task := p.Pick(levels, map[uint64]bool{1: true, 4: true})
+	assert.Equal(t, 1, task.Level)
+	// table 2 overlaps the busy L2 table
+	assert.Equal(t, levels[1][2:], task.Upper)
+	assert.Empty(t, task.Lower)
+
+	// L0, the next level beyond its target, needs the busy table 1
+	assert.Nil(t, p.Pick(levels, map[uint64]bool{1: true, 3: true, 4: true}))
+
+	opts := testOptions
+	opts.Style = SizeTiered
+	assert.Nil(t, NewPicker(opts).Pick(levels, map[uint64]bool{9: true}))
+}
+
+func TestPickMinOverlap(t *testing.T) {
+	opts := testOptions
+	opts.MinOverlap = true
+	levels := [][]Table{
+		{},
+		{{Num: 1, Size: 60, Smallest: "a", Largest: "c"}, {Num: 2, Size: 60, Smallest: "d", Largest: "f"}, {Num: 3, Size: 30, Smallest: "g", Largest: "i"}},
+		{{Num: 4, Size: 100, Smallest: "a", Largest: "b"}, {Num: 5, Size: 20, Smallest: "e", Largest: "e"}, {Num: 6, Size: 20, Smallest: "h", Largest: "h"}},
+		{},
+	}
+	// the same pick every time, it only depends on the levels
+	for i := 0; i < 2; i++ {
+		task := NewPicker(opts).Pick(levels, nil)
+		assert.Equal(t, levels[1][1:2], task.Upper)
+		assert.Equal(t, levels[2][1:2], task.Lower)
+	}
+	task := NewPicker(opts).Pick(levels, map[uint64]bool{5: true})
+	assert.Equal(t, levels[1][2:], task.Upper)
+}
+
+func TestPickBottom(t *testing.T) {
+	p := NewPicker(testOptions)
+	levels := [][]Table{
+		{},
+		{{Num: 1, Size: 60, Smallest: "a", Largest: "c"}, {Num: 2, Size: 60, Smallest: "d", Largest: "f"}},
+		{{Num: 3, Size: 10, Smallest: "b", Largest: "e"}, {Num: 4, Size: 10, Smallest: "x", Largest: "z"}},
+		{{Num: 5, Size: 10, Smallest: "x", Largest: "z"}},
+	}
+	assert.True(t, p.Pick(levels, nil).Bottom)
+	// an older version of a key may lie below
+	levels[3][0].Smallest = "f"
+	assert.False(t, p.Pick(levels, nil).Bottom)
+
+	opts := testOptions
+	opts.Style = SizeTiered
+	p = NewPicker(opts)
+	levels = [][]Table{
+		{{Num: 9, Size: 10, Smallest: "a", Largest: "b"}, {Num: 8, Size: 100, Smallest: "a", Largest: "b"}, {Num: 7, Size: 1000, Smallest: "c", Largest: "d"}, {Num: 6, Size: 10000, Smallest: "x", Largest: "y"}},
+		{},
+	}
+	// the newest tables are merged, the older ones hold other keys
+	assert.True(t, p.Pick(levels, nil).Bottom)
+	levels[0][3].Smallest = "a"
+	assert.False(t, p.Pick(levels, nil).Bottom)
+}
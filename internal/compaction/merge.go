@@ -0,0 +1,165 @@
+package compaction
+
+import (
+	"kv/internal/ratelimit"
+	"kv/internal/sstable"
+)
+
+/*
+Filter sees the newest value of every key a merge writes, tombstones aside, and returns the
+value to write instead, nil to delete the key.
+*/
+type Filter func(key string, val []byte) []byte
+
+type MergeOptions struct {
+	// the byte size at which the outputs are cut
+	TargetSize uint64
+	// if not nil, rewrites the values kept. A key it deletes becomes a tombstone, so that
+	// older versions below stay deleted
+	Filter Filter
+	// if not nil, throttles the bytes read from the inputs
+	Limiter *ratelimit.Limiter
+	// drop tombstones and range tombstones instead of keeping them, for outputs no older
+	// table lies below, see Task.Bottom
+	DropTombstones bool
+}
+
+/*
+Merge the inputs, newest first, into tables of about opts.TargetSize bytes made by newTable.
+Only the newest version of every key is kept, tombstones included, and the keys deleted by
+a range tombstone of a newer input are dropped. The range tombstones themselves are kept to
+shadow the levels below, cut at the boundaries of the outputs, so that the key ranges of
+the outputs are disjoint. With opts.DropTombstones, tombstones and range tombstones are
+dropped as well. Nothing is made if the inputs hold neither keys nor range tombstones to
+keep. On error, the outputs finished so far are left to the caller.
+*/
+func Merge(inputs []*sstable.Reader, opts MergeOptions, newTable func() (*sstable.Writer, error)) error {
+	iters := make([]*sstable.Iterator, len(inputs))
+	for i, input := range inputs {
+		iters[i] = input.NewIterator(&sstable.ReadOptions{Limiter: opts.Limiter})
+	}
+	m := &merger{inputs: inputs, newTable: newTable}
+	if opts.DropTombstones {
+		m.inputs = nil
+	}
+
+	for {
+		// the smallest key of all inputs, the newest input holding it wins
+		next := -1
+		for i, it := range iters {
+			if it.HasNext() && (next < 0 || it.Key() < iters[next].Key()) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		key, val := iters[next].Key(), iters[next].Val()
+		for _, it := range iters[next:] {
+			if it.HasNext() && it.Key() == key {
+				it.Next()
+			}
+		}
+		if rangeDeleted(inputs[:next], key) {
+			continue
+		}
+		if opts.Filter != nil && val != nil {
+			val = opts.Filter(key, val)
+		}
+		if val == nil && opts.DropTombstones {
+			continue
+		}
+		if m.out != nil && m.out.Size() >= opts.TargetSize {
+			if err := m.finish(key, true); err != nil {
+				return err
+			}
+		}
+		if err := m.add(key, val); err != nil {
+			m.abort()
+			return err
+		}
+	}
+	for _, it := range iters {
+		if err := it.Err(); err != nil {
+			m.abort()
+			return err
+		}
+	}
+	// range tombstones are kept even if every key is dropped
+	if m.out == nil {
+		rangeTombstones := 0
+		for _, input := range m.inputs {
+			rangeTombstones += len(input.RangeTombstones())
+		}
+		if rangeTombstones == 0 {
+			return nil
+		}
+		var err error
+		if m.out, err = newTable(); err != nil {
+			return err
+		}
+	}
+	return m.finish("", false)
+}
+
+// whether a range tombstone of the inputs deletes the key
+func rangeDeleted(inputs []*sstable.Reader, key string) bool {
+	for _, input := range inputs {
+		if input.RangeDeleted(key) {
+			return true
+		}
+	}
+	return false
+}
+
+type merger struct {
+	// the inputs whose range tombstones the outputs keep
+	inputs   []*sstable.Reader
+	newTable func() (*sstable.Writer, error)
+	out      *sstable.Writer
+	// the keys of the output being written are at or behind lower, unless it is the first
+	lower    string
+	hasLower bool
+}
+
+func (m *merger) add(key string, val []byte) error {
+	if m.out == nil {
+		var err error
+		if m.out, err = m.newTable(); err != nil {
+			return err
+		}
+	}
+	return m.out.Add(key, val)
+}
+
+/*
+Finish the output with the range tombstones cut to its key range, which ends right before
+upper if hasUpper is set. The next output starts at upper.
+*/
+func (m *merger) finish(upper string, hasUpper bool) error {
+	for _, input := range m.inputs {
+		for _, t := range input.RangeTombstones() {
+			start, end := t.Start, t.End
+			if m.hasLower {
+				start = max(start, m.lower)
+			}
+			if hasUpper {
+				end = min(end, upper)
+			}
+			if start < end {
+				m.out.AddRangeTombstone(start, end)
+			}
+		}
+	}
+	err := m.out.Finish()
+	m.out = nil
+	m.lower, m.hasLower = upper, hasUpper
+	return err
+}
+
+func (m *merger) abort() {
+	if m.out != nil {
+		m.out.Abort()
+		m.out = nil
+	}
+}
@@ -0,0 +1,168 @@
+package compaction
+
+import (
+	"fmt"
+	"kv/internal/sstable"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type entry struct {
+	key string
+	val []byte
+}
+
+func writeTable(t *testing.T, path string, entries []entry, rangeTombstones ...string) *sstable.Reader {
+	w, err := sstable.NewWriter(path, sstable.Options{})
+	assert.NoError(t, err)
+	for _, e := range entries {
+		assert.NoError(t, w.Add(e.key, e.val))
+	}
+	for i := 0; i < len(rangeTombstones); i += 2 {
+		w.AddRangeTombstone(rangeTombstones[i], rangeTombstones[i+1])
+	}
+	assert.NoError(t, w.Finish())
+	r, err := sstable.Open(path)
+	assert.NoError(t, err)
+	return r
+}
+
+// merge the inputs and read the outputs back
+func merge(t *testing.T, dir string, inputs []*sstable.Reader, opts MergeOptions) []*sstable.Reader {
+	paths := []string{}
+	err := Merge(inputs, opts, func() (*sstable.Writer, error) {
+		path := filepath.Join(dir, fmt.Sprintf("out-%d.sst", len(paths)))
+		paths = append(paths, path)
+		return sstable.NewWriter(path, sstable.Options{})
+	})
+	assert.NoError(t, err)
+	outputs := []*sstable.Reader{}
+	for _, path := range paths {
+		r, err := sstable.Open(path)
+		assert.NoError(t, err)
+		t.Cleanup(func() { r.Close() })
+		outputs = append(outputs, r)
+	}
+	return outputs
+}
+
+func readAll(t *testing.T, tables []*sstable.Reader) []entry {
+	entries := []entry{}
+	for _, table := range tables {
+		it := table.NewIterator(nil)
+		for ; it.HasNext(); it.Next() {
+			entries = append(entries, entry{it.Key(), it.Val()})
+		}
+		assert.NoError(t, it.Err())
+	}
+	return entries
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	newest := writeTable(t, filepath.Join(dir, "3.sst"), []entry{{"a", []byte("3")}, {"d", nil}}, "f", "h")
+	middle := writeTable(t, filepath.Join(dir, "2.sst"), []entry{{"a", []byte("2")}, {"b", []byte("2")}, {"g", []byte("2")}})
+	oldest := writeTable(t, filepath.Join(dir, "1.sst"), []entry{{"c", []byte("1")}, {"d", []byte("1")}, {"f", []byte("1")}}, "b", "c")
+	defer newest.Close()
+	defer middle.Close()
+	defer oldest.Close()
+
+	outputs := merge(t, dir, []*sstable.Reader{newest, middle, oldest}, MergeOptions{TargetSize: 1 << 20})
+	assert.Len(t, outputs, 1)
+	// b is only deleted by a tombstone of an older input, the tombstone d is kept
+	assert.Equal(t, []entry{{"a", []byte("3")}, {"b", []byte("2")}, {"c", []byte("1")}, {"d", nil}}, readAll(t, outputs))
+	assert.Len(t, outputs[0].RangeTombstones(), 2)
+	assert.True(t, outputs[0].RangeDeleted("g"))
+}
+
+func TestMergeSplits(t *testing.T) {
+	dir := t.TempDir()
+	entries := []entry{}
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, entry{fmt.Sprintf("key-%04d", i), make([]byte, 100)})
+	}
+	input := writeTable(t, filepath.Join(dir, "1.sst"), entries, "a", "key-0500", "key-0999a", "z")
+	defer input.Close()
+
+	outputs := merge(t, dir, []*sstable.Reader{input}, MergeOptions{TargetSize: 16 * 1024})
+	assert.Greater(t, len(outputs), 4)
+	assert.Equal(t, entries, readAll(t, outputs))
+	// the range tombstones are cut at the boundaries of the outputs
+	for i, output := range outputs {
+		props := output.Properties()
+		for _, rt := range output.RangeTombstones() {
+			if i > 0 {
+				assert.GreaterOrEqual(t, rt.Start, props.MinKey)
+			}
+			if i < len(outputs)-1 {
+				assert.LessOrEqual(t, rt.End, outputs[i+1].Properties().MinKey)
+			}
+		}
+	}
+	assert.Equal(t, "a", outputs[0].RangeTombstones()[0].Start)
+	last := outputs[len(outputs)-1].RangeTombstones()
+	assert.Equal(t, "z", last[len(last)-1].End)
+}
+
+func TestMergeOnlyRangeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	newest := writeTable(t, filepath.Join(dir, "2.sst"), nil, "a", "z")
+	oldest := writeTable(t, filepath.Join(dir, "1.sst"), []entry{{"b", []byte("1")}})
+	defer newest.Close()
+	defer oldest.Close()
+
+	outputs := merge(t, dir, []*sstable.Reader{newest, oldest}, MergeOptions{TargetSize: 1 << 20})
+	assert.Len(t, outputs, 1)
+	assert.Empty(t, readAll(t, outputs))
+	assert.True(t, outputs[0].RangeDeleted("b"))
+
+	empty := writeTable(t, filepath.Join(dir, "3.sst"), nil)
+	defer empty.Close()
+	assert.Empty(t, merge(t, dir, []*sstable.Reader{empty}, MergeOptions{TargetSize: 1 << 20}))
+}
+
+func TestMergeFilter(t *testing.T) {
+	dir := t.TempDir()
+	newest := writeTable(t, filepath.Join(dir, "2.sst"), []entry{{"a", []byte("2")}, {"c", nil}})
+	oldest := writeTable(t, filepath.Join(dir, "1.sst"), []entry{{"a", []byte("1")}, {"b", []byte("1")}, {"c", []byte("1")}, {"d", []byte("1")}})
+	defer newest.Close()
+	defer oldest.Close()
+
+	seen := []entry{}
+	filter := func(key string, val []byte) []byte {
+		seen = append(seen, entry{key, val})
+		switch key {
+		case "b":
+			return nil
+		case "d":
+			return []byte("rewritten")
+		}
+		return val
+	}
+	outputs := merge(t, dir, []*sstable.Reader{newest, oldest}, MergeOptions{TargetSize: 1 << 20, Filter: filter})
+	// only the newest value of live keys is filtered
+	assert.Equal(t, []entry{{"a", []byte("2")}, {"b", []byte("1")}, {"d", []byte("1")}}, seen)
+	// a deleted key leaves a tombstone behind
+	assert.Equal(t, []entry{{"a", []byte("2")}, {"b", nil}, {"c", nil}, {"d", []byte("rewritten")}}, readAll(t, outputs))
+}
+
+func TestMergeDropTombstones(t *testing.T) {
+	dir := t.TempDir()
+	newest := writeTable(t, filepath.Join(dir, "2.sst"), []entry{{"a", nil}, {"c", []byte("2")}}, "b", "d")
+	oldest := writeTable(t, filepath.Join(dir, "1.sst"), []entry{{"a", []byte("1")}, {"b", []byte("1")}, {"e", []byte("1")}})
+	defer newest.Close()
+	defer oldest.Close()
+
+	// the tombstones are gone along with the keys they delete
+	outputs := merge(t, dir, []*sstable.Reader{newest, oldest}, MergeOptions{TargetSize: 1 << 20, DropTombstones: true})
+	assert.Len(t, outputs, 1)
+	assert.Equal(t, []entry{{"c", []byte("2")}, {"e", []byte("1")}}, readAll(t, outputs))
+	assert.Empty(t, outputs[0].RangeTombstones())
+
+	// nothing is left of tombstones only
+	deleted := writeTable(t, filepath.Join(dir, "3.sst"), []entry{{"a", nil}}, "a", "z")
+	defer deleted.Close()
+	assert.Empty(t, merge(t, dir, []*sstable.Reader{deleted}, MergeOptions{TargetSize: 1 << 20, DropTombstones: true}))
+}
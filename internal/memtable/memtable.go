@@ -1,42 +1,123 @@
 package memtable
 
 import (
+	"math/rand"
 	"sync"
 )
 
 const (
 	// if the mutable(1st) skiplist exceeds the threshold,
 	// then it will be frozen and a new skiplist will be created.
-	skipListThreshold = 256 * 1024 * 1024
+	DefaultSkipListThreshold = 256 * 1024 * 1024
+	DefaultSkipListHeight    = maxHeight
 )
 
-type memtable struct {
+type Memtable struct {
 	// sorted by created time desending(the latest one has the index 0)
 	skiplists []*Skiplist
 	rwMutex   sync.RWMutex
+
+	threshold uint32
+	height    uint8
+	// seeds the source of each new skiplist
+	seeds *rand.Rand
 }
 
-func NewMemtable() *memtable {
-	return &memtable{
+// The skiplists are seeded from seed, so the same seed gives the same skiplists.
+func NewMemtable(threshold uint32, height uint8, seed int64) *Memtable {
+	return &Memtable{
 		skiplists: make([]*Skiplist, 0),
+		threshold: threshold,
+		height:    height,
+		seeds:     rand.New(rand.NewSource(seed)),
 	}
 }
 
-func (mt *memtable) Get(key string) ([]byte, bool) {
+func (mt *Memtable) Get(key string) ([]byte, bool) {
+	val, found := mt.Lookup(key)
+	return val, found && val != nil
+}
+
+/*
+Report whether the memtable decides about the key, with a nil val if the key is deleted
+by a tombstone or a range tombstone. Only keys the memtable knows nothing about are left
+to the older tables.
+*/
+func (mt *Memtable) Lookup(key string) ([]byte, bool) {
+	mt.rwMutex.RLock()
+	defer mt.rwMutex.RUnlock()
+
+	return mt.lookup(key)
+}
+
+// Look up all keys under a single read lock acquisition.
+func (mt *Memtable) MultiLookup(keys []string) ([][]byte, []bool) {
 	mt.rwMutex.RLock()
 	defer mt.rwMutex.RUnlock()
 
+	vals := make([][]byte, len(keys))
+	founds := make([]bool, len(keys))
+	for i, key := range keys {
+		vals[i], founds[i] = mt.lookup(key)
+	}
+	return vals, founds
+}
+
+func (mt *Memtable) lookup(key string) ([]byte, bool) {
 	for _, st := range mt.skiplists {
 		node := st.Get(key)
-		if node == nil {
-			continue
+		if node != nil {
+			// a nil val is a tombstone shadowing older skiplists
+			return node.GetVal(), true
+		}
+		// the keys of a skiplist are newer than its range tombstones
+		if st.RangeDeleted(key) {
+			return nil, true
 		}
-		return node.GetVal(), true
 	}
 	return nil, false
 }
 
-func (mt *memtable) popSkiplist() {
+// the number of skiplists, the mutable one included
+func (mt *Memtable) Len() int {
+	mt.rwMutex.RLock()
+	defer mt.rwMutex.RUnlock()
+
+	return len(mt.skiplists)
+}
+
+/*
+Report whether the next write would start a new mutable skiplist, so that the caller can
+Freeze beforehand and know where the skiplist begins. A range tombstone needs an empty
+mutable skiplist, any other write one below the threshold.
+*/
+func (mt *Memtable) WillFreeze(rangeDelete bool) bool {
+	mt.rwMutex.RLock()
+	defer mt.rwMutex.RUnlock()
+
+	if rangeDelete {
+		return len(mt.skiplists) == 0 || !mt.skiplists[0].IsEmpty()
+	}
+	return len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= mt.threshold
+}
+
+// Report whether the mutable skiplist, if any, holds neither keys nor range tombstones.
+func (mt *Memtable) MutableEmpty() bool {
+	mt.rwMutex.RLock()
+	defer mt.rwMutex.RUnlock()
+
+	return len(mt.skiplists) == 0 || mt.skiplists[0].IsEmpty() && len(mt.skiplists[0].RangeTombstones()) == 0
+}
+
+// Freeze the mutable skiplist, if any, and start a new one.
+func (mt *Memtable) Freeze() {
+	mt.rwMutex.Lock()
+	defer mt.rwMutex.Unlock()
+
+	mt.newSkiplist()
+}
+
+func (mt *Memtable) popSkiplist() {
 	len_ := len(mt.skiplists)
 	if len_ == 0 {
 		return
@@ -44,62 +125,110 @@ func (mt *memtable) popSkiplist() {
 	mt.skiplists = mt.skiplists[:len_-1]
 }
 
-func (mt *memtable) newSkiplist() {
-	mt.skiplists = append([]*Skiplist{NewSkipList()}, mt.skiplists...)
+func (mt *Memtable) newSkiplist() {
+	mt.skiplists = append([]*Skiplist{NewSkipList(mt.height, rand.NewSource(mt.seeds.Int63()))}, mt.skiplists...)
 }
 
-func (mt *memtable) Update(key string, val []byte) bool {
+func (mt *Memtable) Update(key string, val []byte) bool {
 	mt.rwMutex.Lock()
 	defer mt.rwMutex.Unlock()
 
 	if val == nil {
 		panic("Nil val")
 	}
-	if len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= skipListThreshold {
+	if len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= mt.threshold {
 		mt.newSkiplist()
 	}
 	return mt.skiplists[0].Update(key, val)
 }
 
-func (mt *memtable) Delete(key string) bool {
+func (mt *Memtable) Delete(key string) bool {
 	mt.rwMutex.Lock()
 	defer mt.rwMutex.Unlock()
 
-	if len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= skipListThreshold {
+	if len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= mt.threshold {
 		mt.newSkiplist()
 	}
 	return mt.skiplists[0].Update(key, nil)
 }
 
+/*
+Delete all keys in [start, end) by a single range tombstone. The tombstone goes to a fresh
+skiplist unless the mutable one is still empty, so that it never shadows keys written after it.
+*/
+func (mt *Memtable) DeleteRange(start, end string) {
+	mt.rwMutex.Lock()
+	defer mt.rwMutex.Unlock()
+
+	if len(mt.skiplists) == 0 || !mt.skiplists[0].IsEmpty() {
+		mt.newSkiplist()
+	}
+	mt.skiplists[0].DeleteRange(start, end)
+}
+
+// a nil Val marks a deletion
+type KV struct {
+	Key string
+	Val []byte
+}
+
+/*
+Apply all KV pairs under a single lock acquisition so that readers either see the whole
+batch or none of it. The threshold is only checked once, so the batch never straddles
+2 skiplists.
+*/
+func (mt *Memtable) UpdateBatch(kvs []KV) {
+	mt.rwMutex.Lock()
+	defer mt.rwMutex.Unlock()
+
+	if len(mt.skiplists) == 0 || mt.skiplists[0].GetSize() >= mt.threshold {
+		mt.newSkiplist()
+	}
+	for _, kv := range kvs {
+		mt.skiplists[0].Update(kv.Key, kv.Val)
+	}
+}
+
 type Iterator interface {
-	getKey() string
-	getVal() string
-	next()
-	hasNext() bool
+	Key() string
+	// a nil val is a tombstone
+	Val() []byte
+	Next()
+	HasNext() bool
 }
 
+// iterates the KV pairs of a skiplist in key order, tombstones included
 type MemtableIterator struct {
 	st     *Skiplist
 	cursor *node
 }
 
-func (it *MemtableIterator) getKey() string {
+func (it *MemtableIterator) Key() string {
 	return it.cursor.key
 }
 
-func (it *MemtableIterator) getVal() string {
-	return string(it.cursor.val)
+func (it *MemtableIterator) Val() []byte {
+	return it.cursor.val
 }
 
-func (it *MemtableIterator) next() {
+func (it *MemtableIterator) Next() {
 	it.cursor = it.cursor.nexts[0]
 }
 
-func (it *MemtableIterator) hasNext() bool {
+func (it *MemtableIterator) HasNext() bool {
 	return it.cursor != nil && it.cursor != it.st.tail
 }
 
-func (mt *memtable) getLastIterator() *MemtableIterator {
+// the range tombstones of the skiplist being iterated
+func (it *MemtableIterator) RangeTombstones() []RangeTombstone {
+	return it.st.RangeTombstones()
+}
+
+// iterate the oldest frozen skiplist, nil if no skiplist is frozen
+func (mt *Memtable) LastIterator() *MemtableIterator {
+	mt.rwMutex.RLock()
+	defer mt.rwMutex.RUnlock()
+
 	if len(mt.skiplists) <= 1 {
 		return nil
 	}
@@ -109,3 +238,24 @@ func (mt *memtable) getLastIterator() *MemtableIterator {
 		cursor: lastSkiplist.head.nexts[0],
 	}
 }
+
+/*
+Persist the oldest frozen skiplist with flush and drop it from the memtable once flush
+succeeds. A frozen skiplist is never written again, so it is iterated without holding the
+lock and readers keep finding its keys till it is dropped. Report false if no skiplist is
+frozen. Flushes must not run concurrently.
+*/
+func (mt *Memtable) FlushLast(flush func(it *MemtableIterator) error) (bool, error) {
+	it := mt.LastIterator()
+	if it == nil {
+		return false, nil
+	}
+	if err := flush(it); err != nil {
+		return false, err
+	}
+
+	mt.rwMutex.Lock()
+	defer mt.rwMutex.Unlock()
+	mt.popSkiplist()
+	return true, nil
+}
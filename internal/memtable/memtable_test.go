@@ -0,0 +1,179 @@
+package memtable
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemtableTombstone(t *testing.T) {
+	mt := NewMemtable(DefaultSkipListThreshold, DefaultSkipListHeight, 1)
+	_, ok := mt.Get("key")
+	assert.False(t, ok)
+
+	mt.Update("key", []byte("val"))
+	val, ok := mt.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "val", string(val))
+
+	mt.Delete("key")
+	val, ok = mt.Get("key")
+	assert.False(t, ok)
+	assert.Nil(t, val)
+
+	// a tombstone in the mutable skiplist shadows older skiplists
+	mt.Update("old", []byte("val"))
+	mt.newSkiplist()
+	mt.Delete("old")
+	_, ok = mt.Get("old")
+	assert.False(t, ok)
+}
+
+func TestMemtableThreshold(t *testing.T) {
+	mt := NewMemtable(64, DefaultSkipListHeight, 1)
+	for i := 0; i < 10; i++ {
+		mt.Update(fmt.Sprintf("key-%02d", i), make([]byte, 26))
+	}
+	// each KV pair takes 32 bytes, so a skiplist is frozen every 2 pairs
+	assert.Equal(t, 5, len(mt.skiplists))
+	for i := 0; i < 10; i++ {
+		_, ok := mt.Get(fmt.Sprintf("key-%02d", i))
+		assert.True(t, ok)
+	}
+}
+
+func TestMemtableUpdateBatch(t *testing.T) {
+	mt := NewMemtable(64, DefaultSkipListHeight, 1)
+	mt.Update("deleted", []byte("val"))
+	batch := []KV{}
+	for i := 0; i < 10; i++ {
+		batch = append(batch, KV{Key: fmt.Sprintf("key-%02d", i), Val: make([]byte, 26)})
+	}
+	batch = append(batch, KV{Key: "deleted"})
+	mt.UpdateBatch(batch)
+
+	// the batch exceeds the threshold but lands in a single skiplist
+	assert.Equal(t, 1, len(mt.skiplists))
+	for i := 0; i < 10; i++ {
+		_, ok := mt.Get(fmt.Sprintf("key-%02d", i))
+		assert.True(t, ok)
+	}
+	_, ok := mt.Get("deleted")
+	assert.False(t, ok)
+}
+
+func TestMemtableMultiLookup(t *testing.T) {
+	mt := NewMemtable(DefaultSkipListThreshold, DefaultSkipListHeight, 1)
+	mt.Update("old", []byte("old"))
+	mt.Update("deleted", []byte("val"))
+	mt.newSkiplist()
+	mt.Update("new", []byte("new"))
+	mt.Delete("deleted")
+
+	// a deleted key is decided by the memtable, an absent one is not
+	vals, founds := mt.MultiLookup([]string{"new", "old", "deleted", "absent", "new"})
+	assert.Equal(t, [][]byte{[]byte("new"), []byte("old"), nil, nil, []byte("new")}, vals)
+	assert.Equal(t, []bool{true, true, true, false, true}, founds)
+
+	vals, founds = mt.MultiLookup(nil)
+	assert.Empty(t, vals)
+	assert.Empty(t, founds)
+}
+
+func TestMemtableFreeze(t *testing.T) {
+	mt := NewMemtable(64, DefaultSkipListHeight, 1)
+	assert.True(t, mt.WillFreeze(false))
+	assert.True(t, mt.WillFreeze(true))
+	mt.Freeze()
+	assert.Equal(t, 1, mt.Len())
+	assert.False(t, mt.WillFreeze(false))
+	assert.False(t, mt.WillFreeze(true))
+
+	mt.Update("key-00", make([]byte, 26))
+	assert.False(t, mt.WillFreeze(false))
+	assert.True(t, mt.WillFreeze(true))
+	mt.Update("key-01", make([]byte, 26))
+	assert.True(t, mt.WillFreeze(false))
+
+	// freezing beforehand keeps the write from starting another skiplist
+	mt.Freeze()
+	mt.Update("key-02", make([]byte, 26))
+	assert.Equal(t, 2, mt.Len())
+	mt.DeleteRange("a", "b")
+	assert.Equal(t, 3, mt.Len())
+}
+
+func TestMemtableMutableEmpty(t *testing.T) {
+	mt := NewMemtable(DefaultSkipListThreshold, DefaultSkipListHeight, 1)
+	assert.True(t, mt.MutableEmpty())
+	mt.Freeze()
+	assert.True(t, mt.MutableEmpty())
+	// a skiplist holding only a range tombstone still shadows older data
+	mt.DeleteRange("a", "b")
+	assert.False(t, mt.MutableEmpty())
+	mt.Freeze()
+	mt.Update("a", []byte("val"))
+	assert.False(t, mt.MutableEmpty())
+}
+
+func TestMemtableDeleteRange(t *testing.T) {
+	mt := NewMemtable(DefaultSkipListThreshold, DefaultSkipListHeight, 1)
+	for i := 0; i < 10; i++ {
+		mt.Update(fmt.Sprintf("key-%02d", i), []byte("val"))
+	}
+	mt.DeleteRange("key-03", "key-07")
+	val, found := mt.Lookup("key-05")
+	assert.True(t, found)
+	assert.Nil(t, val)
+	// a range tombstone never lands in a skiplist holding older keys
+	assert.Equal(t, 2, len(mt.skiplists))
+	mt.DeleteRange("key-08", "key-09")
+	assert.Equal(t, 2, len(mt.skiplists))
+
+	for i := 0; i < 10; i++ {
+		_, ok := mt.Get(fmt.Sprintf("key-%02d", i))
+		assert.Equal(t, i < 3 || i == 7 || i == 9, ok)
+	}
+
+	// keys written after the tombstone are visible again
+	mt.Update("key-04", []byte("new"))
+	val, ok := mt.Get("key-04")
+	assert.True(t, ok)
+	assert.Equal(t, "new", string(val))
+	_, ok = mt.Get("key-05")
+	assert.False(t, ok)
+}
+
+func TestMemtableFlushLast(t *testing.T) {
+	mt := NewMemtable(64, DefaultSkipListHeight, 1)
+	for i := 0; i < 4; i++ {
+		mt.Update(fmt.Sprintf("key-%02d", i), make([]byte, 26))
+	}
+	assert.Equal(t, 2, len(mt.skiplists))
+
+	// a failed flush keeps the skiplist
+	_, err := mt.FlushLast(func(*MemtableIterator) error { return errors.New("disk full") })
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(mt.skiplists))
+
+	keys := []string{}
+	flushed, err := mt.FlushLast(func(it *MemtableIterator) error {
+		for ; it.HasNext(); it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, flushed)
+	assert.Equal(t, []string{"key-00", "key-01"}, keys)
+	assert.Equal(t, 1, len(mt.skiplists))
+	_, ok := mt.Get("key-00")
+	assert.False(t, ok)
+
+	// the mutable skiplist is never flushed
+	flushed, err = mt.FlushLast(func(*MemtableIterator) error { return nil })
+	assert.NoError(t, err)
+	assert.False(t, flushed)
+}
@@ -9,23 +9,26 @@ import (
 The non-thread safe implementation of skip list. Extra synchronization is needed.
 The skiplist only supports insertions and updates. Deletions can be done by marked
 as deleted(update the value to nil).
-Using 0-1 random numbers to determine whether a node needs to be lifted.
+Using 0-1 random numbers to determine whether a node needs to be lifted, drawn from a source
+of the skiplist's own, so that skiplists neither share the lock of the global source nor
+differ between runs given the same seed.
 */
 
 const (
+	// the default height of skiplists
 	maxHeight = uint8(16)
 )
 
 /*
 This function returns the overall layer number that a node can be lifted to.
-It ranges from 1 to maxHeight(both inclusively).
+It ranges from 1 to height(both inclusively).
 A node at each layer has 1/2 of possibility to be lifted to the upper layer.
-So a node has (1/2) ^ 15 of possibility to be lifted to the uppermost layer.
+So with the default height a node has (1/2) ^ 15 of possibility to be lifted to the uppermost layer.
 */
-func liftLayers() uint8 {
+func liftLayers(height uint8, rng *rand.Rand) uint8 {
 	layer := uint8(1)
-	for ; layer < maxHeight; layer++ {
-		if rand.Intn(2) == 0 {
+	for ; layer < height; layer++ {
+		if rng.Intn(2) == 0 {
 			break
 		}
 	}
@@ -42,8 +45,19 @@ func (n *node) GetVal() []byte {
 	return n.val
 }
 
+// deletes all keys in [Start, End)
+type RangeTombstone struct {
+	Start, End string
+}
+
 type Skiplist struct {
 	head, tail *node
+	// shadow keys of older skiplists only, keys in this skiplist were written after them
+	rangeTombstones []RangeTombstone
+	// the number of layers, each node has at most height next pointers
+	height uint8
+	// decides the layers of new nodes, guarded like the nodes themselves
+	rng *rand.Rand
 	// only count non-nil KV pairs
 	len uint32
 	// the byte size occupied by all KV pairs
@@ -51,13 +65,16 @@ type Skiplist struct {
 	rwMutex sync.RWMutex
 }
 
-func NewSkipList() *Skiplist {
-	head := node{nexts: make([]*node, maxHeight)}
-	tail := node{nexts: make([]*node, maxHeight)}
-	for i := uint8(0); i < maxHeight; i++ {
+func NewSkipList(height uint8, src rand.Source) *Skiplist {
+	if height == 0 {
+		panic("Zero height")
+	}
+	head := node{nexts: make([]*node, height)}
+	tail := node{nexts: make([]*node, height)}
+	for i := uint8(0); i < height; i++ {
 		head.nexts[i] = &tail
 	}
-	return &Skiplist{head: &head, tail: &tail, size: 0}
+	return &Skiplist{head: &head, tail: &tail, height: height, rng: rand.New(src), size: 0}
 }
 
 func newNode(key string, val []byte, layerNum uint8) *node {
@@ -81,16 +98,17 @@ func (st *Skiplist) GetSize() uint32 {
 	return uint32(st.size)
 }
 
+// whether no node is linked, tombstones and pairs of an empty key and value count as nodes
 func (st *Skiplist) IsEmpty() bool {
 	st.rwMutex.RLock()
 	defer st.rwMutex.RUnlock()
 
-	return st.size == 0
+	return st.head.nexts[0] == st.tail
 }
 
-func initBound(initNode *node) []*node {
-	bounds := make([]*node, maxHeight)
-	for i := uint8(0); i < maxHeight; i++ {
+func initBound(initNode *node, height uint8) []*node {
+	bounds := make([]*node, height)
+	for i := uint8(0); i < height; i++ {
 		bounds[i] = initNode
 	}
 	return bounds
@@ -118,17 +136,19 @@ If a newly inserted node is lifted to the nth layer, we can have the nth left bo
 point to the node and have the node point to the right bound.
 */
 func (st *Skiplist) searchBounds(key string) ([]*node, []*node) {
-	leftBounds := initBound(st.head)
-	rightBounds := initBound(st.tail)
+	leftBounds := initBound(st.head, st.height)
+	rightBounds := initBound(st.tail, st.height)
 
-	if st.size == uint32(0) {
+	// size ignores empty keys and values, only an unlinked head tells that there are no nodes
+	if st.head.nexts[0] == st.tail {
 		return leftBounds, rightBounds
 	}
 
-	leftBounds[maxHeight-1] = st.head
-	rightBounds[maxHeight-1] = st.head.nexts[maxHeight-1]
+	top := st.height - 1
+	leftBounds[top] = st.head
+	rightBounds[top] = st.tail
 
-	for i := maxHeight - 1; ; i-- {
+	for i := top; ; i-- {
 		leftBound, rightBound := narrowDownBound(st.head, st.tail, leftBounds[i], rightBounds[i], key, i)
 		leftBounds[i] = leftBound
 		rightBounds[i] = rightBound
@@ -150,7 +170,7 @@ func (st *Skiplist) searchWithBounds(key string, leftBounds []*node, rightBounds
 	if leftBounds[0] != st.head && leftBounds[0].key == key {
 		return leftBounds[0]
 	}
-	if rightBounds[0] != st.head && rightBounds[0].key == key {
+	if rightBounds[0] != st.tail && rightBounds[0].key == key {
 		return rightBounds[0]
 	}
 	return nil
@@ -168,24 +188,48 @@ func (st *Skiplist) Update(key string, val []byte) bool {
 	leftBounds, rightBounds := st.searchBounds(key)
 	node := st.searchWithBounds(key, leftBounds, rightBounds)
 	if node != nil {
-		// the node was marked as deleted before
-		if node.val == nil {
+		// the node was marked as deleted before and is revived, or the other way round
+		if node.val == nil && val != nil {
 			st.len += 1
-			st.size += uint32(len(val))
-		} else {
-			st.size -= uint32(len(node.val))
-			st.size += uint32(len(val))
-			node.val = val
+		} else if node.val != nil && val == nil {
+			st.len -= 1
 		}
+		st.size -= uint32(len(node.val))
+		st.size += uint32(len(val))
+		node.val = val
 		return true
 	}
-	layerNum := liftLayers()
+	layerNum := liftLayers(st.height, st.rng)
 	node = newNode(key, val, layerNum)
 	for i := uint8(0); i < layerNum; i++ {
 		leftBounds[i].nexts[i] = node
 		node.nexts[i] = rightBounds[i]
 	}
-	st.len += 1
+	if val != nil {
+		st.len += 1
+	}
 	st.size += uint32(len(key) + len(val))
 	return true
 }
+
+/*
+Record a tombstone for [start, end) without touching the nodes in range. It only shadows
+older skiplists, so the caller must not put it into a skiplist already holding keys that
+were written before it.
+*/
+func (st *Skiplist) DeleteRange(start, end string) {
+	st.rangeTombstones = append(st.rangeTombstones, RangeTombstone{Start: start, End: end})
+}
+
+func (st *Skiplist) RangeTombstones() []RangeTombstone {
+	return st.rangeTombstones
+}
+
+func (st *Skiplist) RangeDeleted(key string) bool {
+	for _, t := range st.rangeTombstones {
+		if t.Start <= key && key < t.End {
+			return true
+		}
+	}
+	return false
+}
@@ -2,21 +2,42 @@ package memtable
 
 import (
 	"kv/test"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLiftLayers(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
 	testTimes := 1000
 	for i := 0; i < testTimes; i++ {
-		assert.LessOrEqual(t, liftLayers(), maxHeight)
-		assert.GreaterOrEqual(t, liftLayers(), uint8(1))
+		assert.LessOrEqual(t, liftLayers(maxHeight, rng), maxHeight)
+		assert.GreaterOrEqual(t, liftLayers(maxHeight, rng), uint8(1))
 	}
 }
 
+func TestSkipListSeed(t *testing.T) {
+	// the same seed lifts the same nodes
+	strs := test.RandStrs(10, 200)
+	layers := func(seed int64) []int {
+		st := NewSkipList(maxHeight, rand.NewSource(seed))
+		for _, str := range strs {
+			st.Update(str, []byte(str))
+		}
+		res := []int{}
+		for _, str := range strs {
+			res = append(res, len(st.Get(str).nexts))
+		}
+		return res
+	}
+	assert.Equal(t, layers(1), layers(1))
+	assert.NotEqual(t, layers(1), layers(2))
+}
+
 func TestNewSkipList(t *testing.T) {
-	st := NewSkipList()
+	st := NewSkipList(maxHeight, rand.NewSource(1))
 
 	assert.Equal(t, uint8(len(st.head.nexts)), maxHeight)
 	for _, headNext := range st.head.nexts {
@@ -30,10 +51,19 @@ func TestNewSkipList(t *testing.T) {
 
 	assert.Zero(t, st.GetSize())
 	assert.True(t, st.IsEmpty())
+
+	// a pair of an empty key and value takes no bytes, the skiplist is not empty all the same
+	st.Update("", []byte{})
+	assert.Zero(t, st.GetSize())
+	assert.False(t, st.IsEmpty())
+	assert.Equal(t, []byte{}, st.Get("").val)
+	st.Update("a", nil)
+	assert.Equal(t, []byte{}, st.Get("").val)
+	assert.Nil(t, st.Get("a").val)
 }
 
 func TestUpdateAndGet(t *testing.T) {
-	st := NewSkipList()
+	st := NewSkipList(maxHeight, rand.NewSource(1))
 	strs := test.RandStrs(1000, 100)
 	for _, str := range strs {
 		st.Update(str, []byte(str))
@@ -48,3 +78,49 @@ func TestUpdateAndGet(t *testing.T) {
 		assert.Nil(t, st.Get(str).val)
 	}
 }
+
+func TestUpdateAfterDelete(t *testing.T) {
+	st := NewSkipList(maxHeight, rand.NewSource(1))
+	st.Update("key", []byte("val"))
+	assert.Equal(t, uint32(1), st.GetLen())
+	st.Update("key", nil)
+	assert.Nil(t, st.Get("key").val)
+	assert.Zero(t, st.GetLen())
+	st.Update("key", []byte("new"))
+	assert.Equal(t, "new", string(st.Get("key").val))
+	assert.Equal(t, uint32(1), st.GetLen())
+	assert.Equal(t, uint32(len("key")+len("new")), st.GetSize())
+
+	// a tombstone for an absent key is not counted as a KV pair
+	st.Update("absent", nil)
+	assert.Equal(t, uint32(1), st.GetLen())
+}
+
+func TestSkipListHeight(t *testing.T) {
+	for _, height := range []uint8{1, 4, 32} {
+		st := NewSkipList(height, rand.NewSource(1))
+		assert.Equal(t, int(height), len(st.head.nexts))
+		strs := test.RandStrs(10, 200)
+		for _, str := range strs {
+			st.Update(str, []byte(str))
+		}
+		for _, str := range strs {
+			assert.Equal(t, str, string(st.Get(str).val))
+			assert.LessOrEqual(t, len(st.Get(str).nexts), int(height))
+		}
+
+		// the bottom layer links all nodes in ascending order
+		sort.Strings(strs)
+		cur := st.head.nexts[0]
+		for _, str := range strs {
+			assert.Equal(t, str, cur.key)
+			cur = cur.nexts[0]
+		}
+		assert.Equal(t, st.tail, cur)
+
+		assert.Nil(t, st.Get(""))
+		st.Update("", []byte("empty"))
+		assert.Equal(t, "empty", string(st.Get("").val))
+	}
+	assert.Panics(t, func() { NewSkipList(0, rand.NewSource(1)) })
+}
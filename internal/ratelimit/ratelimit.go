@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Limiter is a token bucket handing out bytes at a fixed rate, saving up at most a second's
+worth while idle. A request larger than the tokens at hand goes into debt, which later
+requests wait off, so that requests of any size are served and the rate holds across all
+callers. A nil *Limiter never waits.
+Limiter is safe for concurrent use.
+*/
+type Limiter struct {
+	mutex sync.Mutex
+	// bytes per second
+	rate   float64
+	tokens float64
+	last   time.Time
+	// the clock, replaced by tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func New(bytesPerSecond int64) *Limiter {
+	return newWithClock(bytesPerSecond, time.Now, time.Sleep)
+}
+
+func newWithClock(bytesPerSecond int64, now func() time.Time, sleep func(time.Duration)) *Limiter {
+	return &Limiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: now(), now: now, sleep: sleep}
+}
+
+// Take n bytes, sleeping till the bucket has paid them off.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	now := l.now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
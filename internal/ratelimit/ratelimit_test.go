@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a clock that only moves when slept on, recording every sleep
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Sleep(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.sleeps = append(clock.sleeps, d)
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestLimiter(t *testing.T) {
+	var l *Limiter
+	l.Wait(1 << 30)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l = newWithClock(10000, clock.Now, clock.Sleep)
+	// a second's worth is at hand from the start
+	l.Wait(10000)
+	assert.Empty(t, clock.sleeps)
+
+	// the rate holds across concurrent callers, each waits off the debt in front of it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Wait(500)
+		}()
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond, 200 * time.Millisecond}, clock.sleeps)
+
+	// a request may exceed the bucket, the debt is paid off as time passes
+	clock.sleeps = nil
+	clock.Advance(200 * time.Millisecond)
+	l.Wait(12000)
+	assert.Equal(t, []time.Duration{1200 * time.Millisecond}, clock.sleeps)
+
+	// idle time saves up at most a second's worth
+	clock.sleeps = nil
+	clock.Advance(time.Hour)
+	l.Wait(10000)
+	assert.Empty(t, clock.sleeps)
+	l.Wait(1000)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, clock.sleeps)
+}
+
+func TestLimiterSleeps(t *testing.T) {
+	// the real clock: a debt of 50ms is slept off, loose bounds keep slow machines green
+	l := New(1000)
+	l.Wait(1000)
+	start := time.Now()
+	l.Wait(50)
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
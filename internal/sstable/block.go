@@ -0,0 +1,152 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// append the CRC32C of buf to it
+func appendChecksum(buf []byte) []byte {
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// verify the CRC32C at the end of buf and strip it
+func verifyChecksum(buf []byte) ([]byte, error) {
+	if len(buf) < checksumSize {
+		return nil, fmt.Errorf("%w: truncated checksum", ErrCorrupt)
+	}
+	data := buf[:len(buf)-checksumSize]
+	if crc32.Checksum(data, crcTable) != binary.LittleEndian.Uint32(buf[len(data):]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	return data, nil
+}
+
+func encodeLens(a, b uint32) []byte {
+	lens := make([]byte, 2*lenSize)
+	binary.LittleEndian.PutUint32(lens, a)
+	binary.LittleEndian.PutUint32(lens[lenSize:], b)
+	return lens
+}
+
+// append a KV pair, a nil val is a tombstone
+func appendPair(buf []byte, key string, val []byte) []byte {
+	valLen := tombstoneLen
+	if val != nil {
+		valLen = uint32(len(val))
+	}
+	buf = append(buf, encodeLens(uint32(len(key)), valLen)...)
+	buf = append(buf, key...)
+	return append(buf, val...)
+}
+
+// decode the pair at the beginning of buf and return its byte size, a nil val is a tombstone
+func decodePair(buf []byte) (string, []byte, int, error) {
+	if len(buf) < 2*lenSize {
+		return "", nil, 0, fmt.Errorf("%w: truncated KV pair", ErrCorrupt)
+	}
+	keyLen, valLen := uint64(binary.LittleEndian.Uint32(buf)), binary.LittleEndian.Uint32(buf[lenSize:])
+	size := 2*lenSize + keyLen
+	if valLen != tombstoneLen {
+		size += uint64(valLen)
+	}
+	if size > uint64(len(buf)) {
+		return "", nil, 0, fmt.Errorf("%w: truncated KV pair", ErrCorrupt)
+	}
+	key := string(buf[2*lenSize : 2*lenSize+keyLen])
+	if valLen == tombstoneLen {
+		return key, nil, int(size), nil
+	}
+	return key, buf[2*lenSize+keyLen : size : size], int(size), nil
+}
+
+// collects the KV pairs of a data block
+type blockBuilder struct {
+	offsets  []uint32
+	data     []byte
+	firstKey string
+}
+
+func (b *blockBuilder) add(key string, val []byte) {
+	if len(b.offsets) == 0 {
+		b.firstKey = key
+	}
+	b.offsets = append(b.offsets, uint32(len(b.data)))
+	b.data = appendPair(b.data, key, val)
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.offsets) == 0
+}
+
+// the byte size of the encoded block
+func (b *blockBuilder) size() int {
+	return lenSize + lenSize*len(b.offsets) + len(b.data)
+}
+
+func (b *blockBuilder) encode() []byte {
+	buf := make([]byte, lenSize*(1+len(b.offsets)), b.size())
+	binary.LittleEndian.PutUint32(buf, uint32(len(b.offsets)))
+	for i, offset := range b.offsets {
+		binary.LittleEndian.PutUint32(buf[lenSize*(1+i):], offset)
+	}
+	return append(buf, b.data...)
+}
+
+func (b *blockBuilder) reset() {
+	b.offsets = b.offsets[:0]
+	b.data = b.data[:0]
+	b.firstKey = ""
+}
+
+/*
+Parse the header of a data block and return the number of KV pairs in it and a function
+decoding the i-th of them.
+*/
+func parseBlock(block []byte) (int, func(i int) (string, []byte, error), error) {
+	if len(block) < lenSize {
+		return 0, nil, fmt.Errorf("%w: truncated block", ErrCorrupt)
+	}
+	count := uint64(binary.LittleEndian.Uint32(block))
+	if lenSize*(1+count) > uint64(len(block)) {
+		return 0, nil, fmt.Errorf("%w: %d KV pairs overflow the block", ErrCorrupt, count)
+	}
+	data := block[lenSize*(1+count):]
+	pairAt := func(i int) (string, []byte, error) {
+		offset := binary.LittleEndian.Uint32(block[lenSize*(1+i):])
+		if uint64(offset) > uint64(len(data)) {
+			return "", nil, fmt.Errorf("%w: KV offset %d out of the block", ErrCorrupt, offset)
+		}
+		k, val, _, err := decodePair(data[offset:])
+		return k, val, err
+	}
+	return int(count), pairAt, nil
+}
+
+// Binary search a data block for the key, report whether it is found with a nil val for a tombstone.
+func searchBlock(block []byte, key string) ([]byte, bool, error) {
+	count, pairAt, err := parseBlock(block)
+	if err != nil {
+		return nil, false, err
+	}
+	i := sort.Search(count, func(i int) bool {
+		k, _, pairErr := pairAt(i)
+		if pairErr != nil {
+			err = pairErr
+			return true
+		}
+		return k >= key
+	})
+	if err != nil || i == count {
+		return nil, false, err
+	}
+	k, val, err := pairAt(i)
+	if err != nil || k != key {
+		return nil, false, err
+	}
+	return val, true, nil
+}
@@ -0,0 +1,70 @@
+package sstable
+
+import (
+	"hash/fnv"
+)
+
+/*
+A bloom filter over the keys of a table, tombstones included, so that a Get for an absent
+key skips reading a data block in most cases. Probes are derived from a single hash by
+double hashing. An empty filter matches every key.
+
+A filter layout:
+| bits | probe_count |
+| ...  |     1B      |
+*/
+
+const (
+	maxProbes = 30
+)
+
+func bloomHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// build a filter spending about bitsPerKey bits on each key
+func buildFilter(hashes []uint32, bitsPerKey int) []byte {
+	if bitsPerKey <= 0 || len(hashes) == 0 {
+		return nil
+	}
+	// bitsPerKey * ln(2) probes minimize the false positive rate
+	probes := bitsPerKey * 69 / 100
+	probes = max(1, min(probes, maxProbes))
+	// too few bits have a very high false positive rate
+	bits := max(len(hashes)*bitsPerKey, 64)
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	filter := make([]byte, bytes+1)
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := 0; i < probes; i++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[bytes] = byte(probes)
+	return filter
+}
+
+// whether the key may be in the set the filter was built for
+func filterMatches(filter []byte, key string) bool {
+	if len(filter) < 2 {
+		return true
+	}
+	bits := uint32(len(filter)-1) * 8
+	probes := int(filter[len(filter)-1])
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < probes; i++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
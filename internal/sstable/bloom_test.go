@@ -0,0 +1,54 @@
+package sstable
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	hashes := []uint32{}
+	for i := 0; i < 10000; i++ {
+		hashes = append(hashes, bloomHash(fmt.Sprintf("key-%05d", i)))
+	}
+	filter := buildFilter(hashes, 10)
+	assert.Equal(t, byte(6), filter[len(filter)-1])
+	for i := 0; i < 10000; i++ {
+		assert.True(t, filterMatches(filter, fmt.Sprintf("key-%05d", i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filterMatches(filter, fmt.Sprintf("absent-%05d", i)) {
+			falsePositives++
+		}
+	}
+	// about 1% at 10 bits per key
+	assert.Less(t, falsePositives, 300)
+
+	// no filter matches every key
+	assert.Nil(t, buildFilter(hashes, 0))
+	assert.Nil(t, buildFilter(nil, 10))
+	assert.True(t, filterMatches(nil, "key"))
+}
+
+func TestReaderWithoutFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add("key", []byte("val")))
+	assert.NoError(t, w.Finish())
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Empty(t, r.filter)
+	val, found, err := r.Get("key", nil)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("val"), val)
+	_, found, err = r.Get("absent", nil)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
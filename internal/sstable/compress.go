@@ -0,0 +1,60 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// how data blocks are compressed, every block carries its own so mixed tables read fine
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	// DEFLATE of the standard library
+	FlateCompression
+)
+
+const (
+	// blocks shorter than this are stored as is, compressing them hardly pays off
+	minCompressSize = 256
+)
+
+/*
+Compress the block with c and append the compression actually applied: a block that is too
+short or does not shrink is stored uncompressed.
+*/
+func compressBlock(c Compression, block []byte) []byte {
+	if c == NoCompression || len(block) < minCompressSize {
+		return append(block, byte(NoCompression))
+	}
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	writer.Write(block)
+	writer.Close()
+	if buf.Len() >= len(block) {
+		return append(block, byte(NoCompression))
+	}
+	return append(buf.Bytes(), byte(FlateCompression))
+}
+
+// strip the compression of a stored block and decompress it
+func decompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("%w: truncated block", ErrCorrupt)
+	}
+	data := stored[:len(stored)-1]
+	switch c := Compression(stored[len(stored)-1]); c {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		block, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return block, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %d", ErrCorrupt, c)
+	}
+}
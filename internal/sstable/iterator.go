@@ -0,0 +1,94 @@
+package sstable
+
+/*
+Iterator walks the KV pairs of a table in key order, tombstones included, reading one data
+block at a time. A corrupt block ends the iteration early with Err set.
+*/
+type Iterator struct {
+	r  *Reader
+	ro *ReadOptions
+	// the entries of all data blocks and the next one to read
+	index     []indexEntry
+	nextBlock int
+
+	count  int
+	pairAt func(i int) (string, []byte, error)
+	i      int
+
+	key string
+	val []byte
+	err error
+}
+
+// A nil ro reads with the defaults.
+func (r *Reader) NewIterator(ro *ReadOptions) *Iterator {
+	if ro == nil {
+		ro = &ReadOptions{}
+	}
+	if ro.Stats == nil {
+		ro = &ReadOptions{SkipChecksums: ro.SkipChecksums, Stats: &Stats{}, Limiter: ro.Limiter}
+	}
+	it := &Iterator{r: r, ro: ro, index: r.index}
+	if r.partitioned {
+		it.index = nil
+		for _, entry := range r.index {
+			ro.Limiter.Wait(int(entry.size))
+			partition, err := r.readPartition(entry, ro.SkipChecksums, ro.Stats)
+			if err != nil {
+				it.err = err
+				return it
+			}
+			it.index = append(it.index, partition...)
+		}
+	}
+	it.load()
+	return it
+}
+
+// position the iterator at the i-th pair of the current block, or the first of the next ones
+func (it *Iterator) load() {
+	for it.i >= it.count {
+		if it.nextBlock == len(it.index) {
+			it.pairAt = nil
+			return
+		}
+		entry := it.index[it.nextBlock]
+		it.ro.Limiter.Wait(int(entry.size))
+		block, err := it.r.readBlock(entry, it.ro.SkipChecksums, it.ro.Stats)
+		if err == nil {
+			it.count, it.pairAt, err = parseBlock(block)
+		}
+		if err != nil {
+			it.err, it.pairAt = err, nil
+			return
+		}
+		it.nextBlock++
+		it.i = 0
+	}
+	if it.key, it.val, it.err = it.pairAt(it.i); it.err != nil {
+		it.pairAt = nil
+	}
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// a nil val is a tombstone
+func (it *Iterator) Val() []byte {
+	return it.val
+}
+
+func (it *Iterator) Next() {
+	it.i++
+	it.load()
+}
+
+func (it *Iterator) HasNext() bool {
+	return it.err == nil && it.pairAt != nil
+}
+
+// the error that ended the iteration early, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
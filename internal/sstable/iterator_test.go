@@ -0,0 +1,83 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterator(t *testing.T) {
+	dir := t.TempDir()
+	for i, opts := range []Options{{}, {IndexPartitionSize: 64, Compression: FlateCompression}} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.sst", i+1))
+		w, err := NewWriter(path, opts)
+		assert.NoError(t, err)
+		entries := []entry{}
+		for j := 0; j < 1000; j++ {
+			e := entry{key: fmt.Sprintf("key-%04d", j), val: []byte(fmt.Sprintf("val-%04d", j))}
+			if j%10 == 0 {
+				e.val = nil
+			}
+			entries = append(entries, e)
+			assert.NoError(t, w.Add(e.key, e.val))
+		}
+		assert.NoError(t, w.Finish())
+
+		r, err := Open(path)
+		assert.NoError(t, err)
+		got := []entry{}
+		it := r.NewIterator(nil)
+		for ; it.HasNext(); it.Next() {
+			got = append(got, entry{key: it.Key(), val: it.Val()})
+		}
+		assert.NoError(t, it.Err())
+		assert.Equal(t, entries, got)
+		assert.NoError(t, r.Close())
+	}
+
+	// an empty table has nothing to iterate
+	path := filepath.Join(dir, "000003.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	it := r.NewIterator(nil)
+	assert.False(t, it.HasNext())
+	assert.NoError(t, it.Err())
+}
+
+func TestIteratorCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, w.Add(fmt.Sprintf("key-%04d", i), make([]byte, 100)))
+	}
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	second := r.index[1]
+	assert.NoError(t, r.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[second.offset]++
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	r, err = Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	n := 0
+	it := r.NewIterator(nil)
+	for ; it.HasNext(); it.Next() {
+		n++
+	}
+	// the pairs of the first block only
+	assert.Greater(t, n, 0)
+	assert.Less(t, n, 1000)
+	assert.ErrorIs(t, it.Err(), ErrCorrupt)
+}
@@ -0,0 +1,63 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+The properties of a table, gathered while it is written, so that they are known without
+reading its data blocks.
+
+A properties block layout:
+| entries | tombstones | range_tombstones | raw_data_size | data_size | min_key_len | max_key_len | min_key | max_key |
+|   8B    |     8B     |        8B        |      8B       |    8B     |     4B      |     4B      |   ...   |   ...   |
+*/
+type Properties struct {
+	// the smallest and the largest key of the KV pairs, range tombstones aside
+	MinKey string
+	MaxKey string
+	// the KV pairs, tombstones included
+	Entries         uint64
+	Tombstones      uint64
+	RangeTombstones uint64
+	// the bytes of all data blocks before compression, and as stored
+	RawDataSize uint64
+	DataSize    uint64
+}
+
+const (
+	propertiesHeaderSize = 5*8 + 2*lenSize
+)
+
+func (props *Properties) encode() []byte {
+	buf := make([]byte, 0, propertiesHeaderSize+len(props.MinKey)+len(props.MaxKey))
+	for _, n := range []uint64{props.Entries, props.Tombstones, props.RangeTombstones, props.RawDataSize, props.DataSize} {
+		buf = binary.LittleEndian.AppendUint64(buf, n)
+	}
+	buf = append(buf, encodeLens(uint32(len(props.MinKey)), uint32(len(props.MaxKey)))...)
+	buf = append(buf, props.MinKey...)
+	return append(buf, props.MaxKey...)
+}
+
+func decodeProperties(buf []byte) (Properties, error) {
+	if len(buf) < propertiesHeaderSize {
+		return Properties{}, fmt.Errorf("%w: truncated properties block", ErrCorrupt)
+	}
+	props := Properties{
+		Entries:         binary.LittleEndian.Uint64(buf),
+		Tombstones:      binary.LittleEndian.Uint64(buf[8:]),
+		RangeTombstones: binary.LittleEndian.Uint64(buf[16:]),
+		RawDataSize:     binary.LittleEndian.Uint64(buf[24:]),
+		DataSize:        binary.LittleEndian.Uint64(buf[32:]),
+	}
+	minLen := uint64(binary.LittleEndian.Uint32(buf[40:]))
+	maxLen := uint64(binary.LittleEndian.Uint32(buf[44:]))
+	if propertiesHeaderSize+minLen+maxLen != uint64(len(buf)) {
+		return Properties{}, fmt.Errorf("%w: bad key lengths in the properties block", ErrCorrupt)
+	}
+	keys := buf[propertiesHeaderSize:]
+	props.MinKey = string(keys[:minLen])
+	props.MaxKey = string(keys[minLen:])
+	return props, nil
+}
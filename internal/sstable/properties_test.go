@@ -0,0 +1,63 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"kv/internal/memtable"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProperties(t *testing.T) {
+	dir := t.TempDir()
+	for _, version := range []uint32{1, 2, formatVersion} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.sst", version))
+		w, err := NewWriter(path, Options{BitsPerKey: 10, Compression: FlateCompression})
+		assert.NoError(t, err)
+		w.version = version
+		for i := 0; i < 100; i++ {
+			var val []byte
+			// every 10th key is a tombstone
+			if i%10 != 0 {
+				val = bytes.Repeat([]byte("v"), 100)
+			}
+			assert.NoError(t, w.Add(fmt.Sprintf("key-%03d", i), val))
+		}
+		w.AddRangeTombstone("a", "b")
+		w.AddRangeTombstone("x", "z")
+		assert.NoError(t, w.Finish())
+
+		r, err := Open(path)
+		assert.NoError(t, err)
+		props := r.Properties()
+		assert.Equal(t, "key-000", props.MinKey)
+		assert.Equal(t, uint64(100), props.Entries)
+		assert.Equal(t, uint64(2), props.RangeTombstones)
+		assert.Equal(t, r.index[len(r.index)-1].offset+uint64(r.index[len(r.index)-1].size), props.DataSize)
+		assert.Equal(t, "key-099", props.MaxKey)
+		if version < propertiesVersion {
+			// only what the footer and the blocks tell
+			assert.Zero(t, props.Tombstones)
+		} else {
+			assert.Equal(t, uint64(10), props.Tombstones)
+			// the vals compress well
+			assert.Greater(t, props.RawDataSize, 2*props.DataSize)
+		}
+		checkTable(t, path, []entry{{"key-000", nil}, {"key-001", bytes.Repeat([]byte("v"), 100)}},
+			[]memtable.RangeTombstone{{Start: "a", End: "b"}, {Start: "x", End: "z"}})
+		assert.NoError(t, r.Close())
+	}
+}
+
+func TestPropertiesEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, Properties{}, r.Properties())
+}
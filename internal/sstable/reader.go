@@ -0,0 +1,435 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"kv/internal/memtable"
+	"os"
+	"sort"
+)
+
+// a data block and the first key in it
+type indexEntry struct {
+	firstKey string
+	offset   uint64
+	size     uint32
+}
+
+func encodeIndex(index []indexEntry) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(index)))
+	for _, entry := range index {
+		buf = binary.LittleEndian.AppendUint64(buf, entry.offset)
+		buf = binary.LittleEndian.AppendUint32(buf, entry.size)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.firstKey)))
+		buf = append(buf, entry.firstKey...)
+	}
+	return buf
+}
+
+// decode the index block, every data block must lie before end
+func decodeIndex(buf []byte, end uint64) ([]indexEntry, error) {
+	if len(buf) < lenSize {
+		return nil, fmt.Errorf("%w: truncated index block", ErrCorrupt)
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[lenSize:]
+	index := make([]indexEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 16 {
+			return nil, fmt.Errorf("%w: truncated index entry %d", ErrCorrupt, i)
+		}
+		entry := indexEntry{
+			offset: binary.LittleEndian.Uint64(buf),
+			size:   binary.LittleEndian.Uint32(buf[8:]),
+		}
+		keyLen := uint64(binary.LittleEndian.Uint32(buf[12:]))
+		if 16+keyLen > uint64(len(buf)) {
+			return nil, fmt.Errorf("%w: truncated index entry %d", ErrCorrupt, i)
+		}
+		entry.firstKey = string(buf[16 : 16+keyLen])
+		buf = buf[16+keyLen:]
+		if entry.offset+uint64(entry.size) > end {
+			return nil, fmt.Errorf("%w: data block %d runs past the data blocks", ErrCorrupt, i)
+		}
+		index = append(index, entry)
+	}
+	return index, nil
+}
+
+/*
+Reader serves point lookups from a table. Open only loads the index block, the filter and
+the range tombstones, a Get checks the filter, then binary searches the index and reads a
+single data block. If the index is partitioned, a Get reads the index partition that may
+hold the key first.
+Reader is safe for concurrent use.
+*/
+type Reader struct {
+	file    *os.File
+	version uint32
+	size    uint64
+	count   uint32
+	props   Properties
+
+	// the entries of the data blocks, or of the index partitions if partitioned
+	index       []indexEntry
+	partitioned bool
+	// the end of the data blocks, where the index partitions start
+	dataEnd uint64
+
+	filter          []byte
+	rangeTombstones []memtable.RangeTombstone
+}
+
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: file}
+	if err := r.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reader) load() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = uint64(info.Size())
+	if info.Size() < footerTailSize {
+		return fmt.Errorf("%w: %d bytes are too short for a footer", ErrNotTable, info.Size())
+	}
+	tail := make([]byte, footerTailSize)
+	if _, err := r.file.ReadAt(tail, info.Size()-footerTailSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(tail[4:]) != tableMagic {
+		return fmt.Errorf("%w: bad magic number", ErrNotTable)
+	}
+	r.version = binary.LittleEndian.Uint32(tail)
+	if r.version == 0 || r.version > formatVersion {
+		return fmt.Errorf("%w: %d", ErrVersion, r.version)
+	}
+	size := int64(versionFooterSize(r.version))
+	if info.Size() < size {
+		return fmt.Errorf("%w: %d bytes are too short for a footer", ErrCorrupt, info.Size())
+	}
+	footerOffset := uint64(info.Size() - size)
+	footer := make([]byte, size)
+	if _, err := r.file.ReadAt(footer, int64(footerOffset)); err != nil {
+		return err
+	}
+	next := func(n int) []byte {
+		field := footer[:n]
+		footer = footer[n:]
+		return field
+	}
+	rangeTombstonesOffset := binary.LittleEndian.Uint64(next(8))
+	filterOffset := binary.LittleEndian.Uint64(next(8))
+	// older tables have an empty properties block right before the index block
+	propertiesOffset := uint64(0)
+	if r.version >= propertiesVersion {
+		propertiesOffset = binary.LittleEndian.Uint64(next(8))
+	}
+	indexOffset := binary.LittleEndian.Uint64(next(8))
+	if r.version < propertiesVersion {
+		propertiesOffset = indexOffset
+	}
+	r.count = binary.LittleEndian.Uint32(next(lenSize))
+	rangeTombstoneCount := binary.LittleEndian.Uint32(next(lenSize))
+	metaEnd := footerOffset
+	if r.version >= checksumVersion {
+		if metaEnd < checksumSize {
+			return fmt.Errorf("%w: %d bytes are too short for a checksum", ErrCorrupt, info.Size())
+		}
+		metaEnd -= checksumSize
+	}
+	if rangeTombstonesOffset > filterOffset || filterOffset > propertiesOffset || propertiesOffset > indexOffset || indexOffset > metaEnd {
+		return fmt.Errorf("%w: bad offsets in the footer", ErrCorrupt)
+	}
+
+	// the range tombstones, the filter, the properties and the index block are adjacent, read
+	// them at once
+	buf := make([]byte, footerOffset-rangeTombstonesOffset)
+	if _, err := r.file.ReadAt(buf, int64(rangeTombstonesOffset)); err != nil {
+		return err
+	}
+	if r.version >= checksumVersion {
+		if buf, err = verifyChecksum(buf); err != nil {
+			return fmt.Errorf("%w of the blocks behind the data blocks", err)
+		}
+	}
+	index := buf[indexOffset-rangeTombstonesOffset:]
+	if r.version >= partitionVersion {
+		if len(index) == 0 || index[0] > partitionedIndex {
+			return fmt.Errorf("%w: unknown index kind", ErrCorrupt)
+		}
+		r.partitioned = index[0] == partitionedIndex
+		index = index[1:]
+	}
+	if r.index, err = decodeIndex(index, rangeTombstonesOffset); err != nil {
+		return err
+	}
+	r.dataEnd = rangeTombstonesOffset
+	if r.partitioned && len(r.index) > 0 {
+		r.dataEnd = r.index[0].offset
+	}
+	if r.version >= propertiesVersion {
+		if r.props, err = decodeProperties(buf[propertiesOffset-rangeTombstonesOffset : indexOffset-rangeTombstonesOffset]); err != nil {
+			return err
+		}
+	} else if err := r.legacyProperties(rangeTombstoneCount, rangeTombstonesOffset); err != nil {
+		return err
+	}
+	r.filter = buf[filterOffset-rangeTombstonesOffset : propertiesOffset-rangeTombstonesOffset]
+	buf = buf[:filterOffset-rangeTombstonesOffset]
+	for i := uint32(0); i < rangeTombstoneCount; i++ {
+		start, end, size, err := decodePair(buf)
+		if err != nil || end == nil {
+			return fmt.Errorf("%w: range tombstone %d", ErrCorrupt, i)
+		}
+		r.rangeTombstones = append(r.rangeTombstones, memtable.RangeTombstone{Start: start, End: string(end)})
+		buf = buf[size:]
+	}
+	return nil
+}
+
+// the work done by Gets, for explaining slow reads
+type Stats struct {
+	Gets uint64
+	// the Gets the filter was checked for, and those it ruled out without reading a block
+	FilterChecks uint64
+	FilterMisses uint64
+	BlocksRead   uint64
+	// the bytes of data blocks read from the file, and the bytes they decompressed into
+	BytesRead         uint64
+	BytesDecompressed uint64
+}
+
+/*
+Report whether the table holds the key, with a nil val for a tombstone. It reads the one
+block that may hold the key. A nil ro reads with the defaults.
+*/
+func (r *Reader) Get(key string, ro *ReadOptions) ([]byte, bool, error) {
+	if ro == nil {
+		ro = &ReadOptions{}
+	}
+	stats := ro.Stats
+	if stats == nil {
+		stats = &Stats{}
+	}
+	stats.Gets++
+	if len(r.filter) > 0 {
+		stats.FilterChecks++
+		if !filterMatches(r.filter, key) {
+			stats.FilterMisses++
+			return nil, false, nil
+		}
+	}
+	index := r.index
+	if r.partitioned {
+		i := searchIndex(index, key)
+		if i < 0 {
+			return nil, false, nil
+		}
+		var err error
+		if index, err = r.readPartition(index[i], ro.SkipChecksums, stats); err != nil {
+			return nil, false, err
+		}
+	}
+	i := searchIndex(index, key)
+	if i < 0 {
+		return nil, false, nil
+	}
+	block, err := r.readBlock(index[i], ro.SkipChecksums, stats)
+	if err != nil {
+		return nil, false, err
+	}
+	return searchBlock(block, key)
+}
+
+// the last entry of the index starting at or before the key, -1 if there is none
+func searchIndex(index []indexEntry, key string) int {
+	return sort.Search(len(index), func(i int) bool { return index[i].firstKey > key }) - 1
+}
+
+// read the block of the entry and verify its checksum
+func (r *Reader) readStored(entry indexEntry, skipChecksums bool, stats *Stats) ([]byte, error) {
+	stored := make([]byte, entry.size)
+	if _, err := r.file.ReadAt(stored, int64(entry.offset)); err != nil {
+		return nil, err
+	}
+	stats.BlocksRead++
+	stats.BytesRead += uint64(len(stored))
+	if r.version < checksumVersion {
+		return stored, nil
+	}
+	if len(stored) < checksumSize {
+		return nil, fmt.Errorf("%w: truncated block at offset %d", ErrCorrupt, entry.offset)
+	}
+	if !skipChecksums {
+		if _, err := verifyChecksum(stored); err != nil {
+			return nil, fmt.Errorf("%w of the block at offset %d", err, entry.offset)
+		}
+	}
+	return stored[:len(stored)-checksumSize], nil
+}
+
+// read a data block, verify and decompress it
+func (r *Reader) readBlock(entry indexEntry, skipChecksums bool, stats *Stats) ([]byte, error) {
+	stored, err := r.readStored(entry, skipChecksums, stats)
+	if err != nil {
+		return nil, err
+	}
+	block, err := decompressBlock(stored)
+	if err != nil {
+		return nil, err
+	}
+	if Compression(stored[len(stored)-1]) != NoCompression {
+		stats.BytesDecompressed += uint64(len(block))
+	}
+	return block, nil
+}
+
+// read an index partition and decode the entries of its data blocks
+func (r *Reader) readPartition(entry indexEntry, skipChecksums bool, stats *Stats) ([]indexEntry, error) {
+	stored, err := r.readStored(entry, skipChecksums, stats)
+	if err != nil {
+		return nil, err
+	}
+	index, err := decodeIndex(stored, r.dataEnd)
+	if err != nil {
+		return nil, err
+	}
+	if len(index) == 0 || index[0].firstKey != entry.firstKey {
+		return nil, fmt.Errorf("%w: index partition at offset %d does not start at %q", ErrCorrupt, entry.offset, entry.firstKey)
+	}
+	return index, nil
+}
+
+/*
+Read every index partition and data block and check that they are intact, that the keys
+are strictly ascending and that the index, the properties and the footer agree with the
+blocks. It is meant for tables written outside of the DB, a Get only checks the block it
+reads.
+*/
+func (r *Reader) Verify() error {
+	index := r.index
+	if r.partitioned {
+		index = nil
+		for _, entry := range r.index {
+			partition, err := r.readPartition(entry, false, &Stats{})
+			if err != nil {
+				return err
+			}
+			index = append(index, partition...)
+		}
+	}
+	count := uint32(0)
+	firstKey, lastKey := "", ""
+	for _, entry := range index {
+		block, err := r.readBlock(entry, false, &Stats{})
+		if err != nil {
+			return err
+		}
+		n, pairAt, err := parseBlock(block)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: empty block at offset %d", ErrCorrupt, entry.offset)
+		}
+		for j := 0; j < n; j++ {
+			key, _, err := pairAt(j)
+			if err != nil {
+				return err
+			}
+			if j == 0 && key != entry.firstKey {
+				return fmt.Errorf("%w: block at offset %d starts at %q, not %q", ErrCorrupt, entry.offset, key, entry.firstKey)
+			}
+			if count > 0 && key <= lastKey {
+				return fmt.Errorf("%w: %w: %q after %q", ErrCorrupt, ErrUnsorted, key, lastKey)
+			}
+			if count == 0 {
+				firstKey = key
+			}
+			lastKey = key
+			count++
+		}
+	}
+	if count != r.count {
+		return fmt.Errorf("%w: %d KV pairs, the footer tells %d", ErrCorrupt, count, r.count)
+	}
+	if uint64(count) != r.props.Entries {
+		return fmt.Errorf("%w: %d KV pairs, the properties tell %d", ErrCorrupt, count, r.props.Entries)
+	}
+	// without pairs both bounds are empty
+	if r.props.MinKey != firstKey || r.props.MaxKey != lastKey {
+		return fmt.Errorf("%w: keys in [%q, %q], the properties tell [%q, %q]", ErrCorrupt, firstKey, lastKey, r.props.MinKey, r.props.MaxKey)
+	}
+	return nil
+}
+
+// whether a range tombstone of the table deletes the key in older tables
+func (r *Reader) RangeDeleted(key string) bool {
+	for _, t := range r.rangeTombstones {
+		if t.Start <= key && key < t.End {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Fill the properties of tables older than format version 3 from the footer and the index,
+and the last data block for MaxKey.
+*/
+func (r *Reader) legacyProperties(rangeTombstoneCount uint32, dataSize uint64) error {
+	r.props = Properties{Entries: uint64(r.count), RangeTombstones: uint64(rangeTombstoneCount), DataSize: dataSize}
+	if len(r.index) == 0 {
+		return nil
+	}
+	r.props.MinKey = r.index[0].firstKey
+	block, err := r.readBlock(r.index[len(r.index)-1], false, &Stats{})
+	if err != nil {
+		return err
+	}
+	count, pairAt, err := parseBlock(block)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: empty last block", ErrCorrupt)
+	}
+	r.props.MaxKey, _, err = pairAt(count - 1)
+	return err
+}
+
+/*
+The properties of the table. Tables older than format version 3 have no properties block,
+their Tombstones and RawDataSize are left zero.
+*/
+func (r *Reader) Properties() Properties {
+	return r.props
+}
+
+// the byte size of the table file
+func (r *Reader) Size() uint64 {
+	return r.size
+}
+
+func (r *Reader) RangeTombstones() []memtable.RangeTombstone {
+	return r.rangeTombstones
+}
+
+// the path the table was opened at
+func (r *Reader) Path() string {
+	return r.file.Name()
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,300 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"kv/internal/memtable"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaderGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		var val []byte
+		// every 10th key is a tombstone
+		if i%10 != 0 {
+			val = []byte(fmt.Sprintf("val-%04d", i))
+		}
+		assert.NoError(t, w.Add(fmt.Sprintf("key-%04d", 2*i), val))
+	}
+	w.AddRangeTombstone("x", "z")
+	assert.NoError(t, w.Finish())
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	// 1000 pairs of 28 bytes or so span several blocks
+	assert.Greater(t, len(r.index), 1)
+
+	for i := 0; i < 1000; i++ {
+		val, found, err := r.Get(fmt.Sprintf("key-%04d", 2*i), nil)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		if i%10 == 0 {
+			assert.Nil(t, val)
+		} else {
+			assert.Equal(t, fmt.Sprintf("val-%04d", i), string(val))
+		}
+		_, found, err = r.Get(fmt.Sprintf("key-%04d", 2*i+1), nil)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+	for _, key := range []string{"", "a", "key-", "zzz"} {
+		_, found, err := r.Get(key, nil)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+	assert.True(t, r.RangeDeleted("y"))
+	assert.False(t, r.RangeDeleted("z"))
+}
+
+func TestReaderEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	w.AddRangeTombstone("a", "b")
+	assert.NoError(t, w.Finish())
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	_, found, err := r.Get("a", nil)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.True(t, r.RangeDeleted("a"))
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add("key", []byte("val")))
+	assert.NoError(t, w.Finish())
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	footer := len(data) - footerSize
+
+	withByte := func(i int, b byte) []byte {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] = b
+		return corrupt
+	}
+	for _, corrupt := range [][]byte{
+		// the index block starts behind the footer
+		withByte(footer+24, 0xff),
+		// the properties start behind the index block
+		withByte(footer+16, 0xff),
+		// the filter starts behind the properties
+		withByte(footer+8, 0xff),
+		// the range tombstones start behind the filter
+		withByte(footer, 0xff),
+		// bit rot in the index block
+		withByte(footer-checksumSize-1, data[footer-checksumSize-1]^1),
+		// a range tombstone more than there is
+		withByte(footer+36, 1),
+		// a footer cut short
+		data[len(data)-footerSize+1:],
+	} {
+		assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+		_, err := Open(path)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	}
+
+	// files that are no tables are told apart from corrupt tables
+	for _, corrupt := range [][]byte{data[len(data)-footerTailSize+1:], withByte(len(data)-1, 0)} {
+		assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+		_, err := Open(path)
+		assert.ErrorIs(t, err, ErrNotTable)
+	}
+	assert.NoError(t, os.WriteFile(path, withByte(footer+40, formatVersion+1), 0644))
+	_, err = Open(path)
+	assert.ErrorIs(t, err, ErrVersion)
+
+	// bit rot in a data block is only noticed on Get
+	blockEnd := int(binary.LittleEndian.Uint64(data[footer:]))
+	for _, corrupt := range [][]byte{
+		// a KV offset out of bound
+		withByte(lenSize, 0xff),
+		// an unknown compression
+		withByte(blockEnd-checksumSize-1, 0xff),
+	} {
+		assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+		r, err := Open(path)
+		assert.NoError(t, err)
+		_, _, err = r.Get("key", nil)
+		assert.ErrorContains(t, err, "checksum mismatch")
+		_, _, err = r.Get("key", &ReadOptions{SkipChecksums: true})
+		assert.ErrorIs(t, err, ErrCorrupt)
+		assert.NotContains(t, err.Error(), "checksum")
+		assert.NoError(t, r.Close())
+	}
+	// a flipped val goes unnoticed unless checksums are verified
+	assert.NoError(t, os.WriteFile(path, withByte(blockEnd-checksumSize-2, 'x'), 0644))
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	_, _, err = r.Get("key", nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	val, found, err := r.Get("key", &ReadOptions{SkipChecksums: true})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "vax", string(val))
+}
+
+func TestReaderVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10, Compression: FlateCompression})
+	assert.NoError(t, err)
+	w.version = 1
+	entries := []entry{}
+	for i := 0; i < 100; i++ {
+		e := entry{key: fmt.Sprintf("key-%03d", i), val: bytes.Repeat([]byte("v"), 100)}
+		entries = append(entries, e)
+		assert.NoError(t, w.Add(e.key, e.val))
+	}
+	w.AddRangeTombstone("x", "z")
+	assert.NoError(t, w.Finish())
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), r.version)
+	assert.NoError(t, r.Close())
+	checkTable(t, path, entries, []memtable.RangeTombstone{{Start: "x", End: "z"}})
+}
+
+func TestReaderVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	// without checksums, only Verify notices keys out of order
+	w.version = 1
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, w.Add(fmt.Sprintf("key-%03d", i), make([]byte, 100)))
+	}
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Verify())
+	assert.NoError(t, r.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	for _, corrupt := range [][]byte{
+		bytes.Replace(data, []byte("key-050"), []byte("key-999"), 1),
+		// the first key of a block differs from its index entry
+		bytes.Replace(data, []byte("key-000"), []byte("key-!!!"), 1),
+	} {
+		assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+		r, err := Open(path)
+		assert.NoError(t, err)
+		assert.ErrorIs(t, r.Verify(), ErrCorrupt)
+		assert.NoError(t, r.Close())
+	}
+
+	footer := len(data) - versionFooterSize(1)
+	corrupt := append([]byte{}, data...)
+	corrupt[footer+24]++
+	assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+	r, err = Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.ErrorIs(t, r.Verify(), ErrCorrupt)
+}
+
+func TestReaderVerifyProperties(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, w.Add(fmt.Sprintf("key-%03d", i), []byte("val")))
+	}
+	// bounds wider than the keys, the checksums still match
+	w.props.MinKey = "a"
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, "a", r.Properties().MinKey)
+	assert.ErrorIs(t, r.Verify(), ErrCorrupt)
+}
+
+func TestReaderPartitionedIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{IndexPartitionSize: 256})
+	assert.NoError(t, err)
+	entries := []entry{}
+	for i := 0; i < 2000; i++ {
+		e := entry{key: fmt.Sprintf("key-%04d", i), val: make([]byte, 100)}
+		entries = append(entries, e)
+		assert.NoError(t, w.Add(e.key, e.val))
+	}
+	assert.NoError(t, w.Finish())
+	checkTable(t, path, entries, nil)
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.True(t, r.partitioned)
+	// about 60 data blocks of 30 bytes entries in partitions of 256 bytes
+	assert.Greater(t, len(r.index), 5)
+	assert.NoError(t, r.Verify())
+	assert.Equal(t, r.index[0].offset, r.Properties().DataSize)
+
+	stats := &Stats{}
+	_, found, err := r.Get("key-1234", &ReadOptions{Stats: stats})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	// the index partition and the data block
+	assert.Equal(t, uint64(2), stats.BlocksRead)
+	for _, key := range []string{"a", "key-", "key-0000a", "z"} {
+		_, found, err := r.Get(key, nil)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+
+	// a small index is not partitioned
+	small := filepath.Join(t.TempDir(), "000002.sst")
+	w, err = NewWriter(small, Options{IndexPartitionSize: 256})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add("key", []byte("val")))
+	assert.NoError(t, w.Finish())
+	r2, err := Open(small)
+	assert.NoError(t, err)
+	defer r2.Close()
+	assert.False(t, r2.partitioned)
+}
+
+func TestReaderCorruptPartition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{IndexPartitionSize: 64})
+	assert.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, w.Add(fmt.Sprintf("key-%04d", i), make([]byte, 100)))
+	}
+	assert.NoError(t, w.Finish())
+	r, err := Open(path)
+	assert.NoError(t, err)
+	partition := r.index[0]
+	assert.NoError(t, r.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	// the offset of the first data block in the partition
+	data[partition.offset+lenSize]++
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	r, err = Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	_, _, err = r.Get("key-0000", nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorIs(t, r.Verify(), ErrCorrupt)
+	_, _, err = r.Get("key-0000", &ReadOptions{SkipChecksums: true})
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
@@ -0,0 +1,133 @@
+package sstable
+
+import (
+	"errors"
+	"kv/internal/ratelimit"
+)
+
+/*
+An SSTable is a sorted, immutable file holding the KV pairs of a flushed skiplist,
+tombstones included, so that they keep shadowing older tables. The KV pairs are packed into
+data blocks of about blockSize bytes, an index block locates the data blocks, so that a
+lookup only reads the block that may hold its key. A bloom filter (see bloom.go) lets most
+lookups of absent keys skip the read. Data blocks may be compressed (see compress.go).
+
+A table layout:
+| data_blocks | index_partitions | range_tombstones | filter | properties | index_block | checksum | footer |
+|     ...     |       ...        |       ...        |  ...   |    ...     |     ...     |    4B    |  52B   |
+where checksum is the CRC32C of everything between the data blocks and the footer, so that
+it is verified as a whole when the table is opened. The properties block is described in
+properties.go.
+
+A stored data block layout:
+| block | compression | checksum |
+|  ...  |     1B      |    4B    |
+where block is compressed as compression tells, blocks of a table may differ in it, and
+checksum is the CRC32C of everything before it, so that bit rot is detected on read.
+Tables of format version 1 have no checksums at all.
+
+A data block layout:
+| count | kv_offsets  | kv_data |
+|  4B   | count * 4B  |   ...   |
+where each kv_offset is the index(relative to the beginning of the kv_data part) of the
+first byte of a KV pair, like in the leaves of internal/btree. A block only grows past
+blockSize(before compression) if a single KV pair does not fit into it.
+
+A KV pair layout, val is absent for a tombstone:
+| key_len | val_len | key | val |
+|   4B    |   4B    | ... | ... |
+where a val_len of tombstoneLen marks a deleted key.
+
+A range tombstone layout, it deletes the keys in [start, end) of older tables:
+| start_len | end_len | start | end |
+|    4B     |   4B    |  ...  | ... |
+
+The index block holds an entry per data block, in key order:
+| kind | block_count | index_entries |
+|  1B  |     4B      |      ...      |
+where kind is flatIndex. An index larger than the partition size is cut into index
+partitions, each laid out like an index block without kind and followed by its checksum.
+The index block then has the kind partitionedIndex and an entry per partition instead, so
+that only this top level index is held in memory and a lookup reads the one partition
+that may hold its key before the data block.
+
+An index entry layout:
+| block_offset | block_size | key_len | first_key |
+|      8B      |     4B     |   4B    |    ...    |
+where block_size is the size of the stored block.
+
+The footer layout:
+| range_tombstones_offset | filter_offset | properties_offset | index_offset | count | range_tombstone_count | version | magic |
+|           8B            |      8B       |        8B         |      8B      |  4B   |          4B           |   4B    |  8B   |
+where count is the number of KV pairs. magic tells tables from other files, version is the
+format the table is written in. Both stay at the end of the file whatever the version, the
+rest of the footer may change with it.
+
+Older format versions:
+  - version 1 has no checksums
+  - versions 1 and 2 have no properties block, nor properties_offset in their 44B footer
+  - versions 1 to 3 have no index partitions, nor kind in their index block
+*/
+
+const (
+	// the size data blocks are cut at
+	blockSize = 4096
+
+	lenSize      = 4
+	footerSize   = 52
+	tombstoneLen = ^uint32(0)
+
+	checksumSize = 4
+	// the version and the magic number closing every footer
+	footerTailSize = 12
+
+	tableMagic    = 0x6c62747373766b88
+	formatVersion = 4
+	// the first format versions with checksums, properties and index partitions
+	checksumVersion   = 2
+	propertiesVersion = 3
+	partitionVersion  = 4
+
+	flatIndex        = 0
+	partitionedIndex = 1
+	// the byte size beyond which an index block is partitioned
+	defaultIndexPartitionSize = 64 * 1024
+)
+
+// the footer size of a format version
+func versionFooterSize(version uint32) int {
+	if version < propertiesVersion {
+		return footerSize - 8
+	}
+	return footerSize
+}
+
+type Options struct {
+	// the bloom filter bits spent on each key, no filter is written if it is not positive
+	BitsPerKey int
+	// how data blocks are compressed
+	Compression Compression
+	// the byte size of index partitions, an index block is only partitioned beyond it. Zero
+	// stands for defaultIndexPartitionSize
+	IndexPartitionSize int
+	// if not nil, throttles the bytes written
+	Limiter *ratelimit.Limiter
+}
+
+type ReadOptions struct {
+	// do not verify the checksums of the data blocks read, trading the detection of bit rot
+	// for speed
+	SkipChecksums bool
+	// if not nil, the work done is added to it
+	Stats *Stats
+	// if not nil, throttles the bytes read by an Iterator
+	Limiter *ratelimit.Limiter
+}
+
+var (
+	ErrUnsorted = errors.New("sstable: keys not in ascending order")
+	ErrTooLarge = errors.New("sstable: key or value too large")
+	ErrCorrupt  = errors.New("sstable: corrupt table")
+	ErrNotTable = errors.New("sstable: not a table")
+	ErrVersion  = errors.New("sstable: unsupported format version")
+)
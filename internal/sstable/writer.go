@@ -0,0 +1,254 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"kv/internal/memtable"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+const (
+	tmpSuffix = ".tmp"
+)
+
+/*
+Writer writes a table from KV pairs added in ascending key order. The table is written to a
+temporary file and only shows up at its path once Finish succeeds, so a crash never leaves
+a partial table behind.
+*/
+type Writer struct {
+	path string
+	opts Options
+	file *os.File
+	buf  *bufio.Writer
+	// the format version written, only older ones are written by tests
+	version uint32
+
+	offset          uint64
+	count           uint32
+	lastKey         string
+	block           blockBuilder
+	index           []indexEntry
+	rangeTombstones []memtable.RangeTombstone
+	// the bloom hashes of all keys
+	hashes []uint32
+	props  Properties
+}
+
+func NewWriter(path string, opts Options) (*Writer, error) {
+	file, err := os.OpenFile(path+tmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{path: path, opts: opts, version: formatVersion, file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+func (w *Writer) write(parts ...[]byte) error {
+	for _, part := range parts {
+		w.opts.Limiter.Wait(len(part))
+		if _, err := w.buf.Write(part); err != nil {
+			return err
+		}
+		w.offset += uint64(len(part))
+	}
+	return nil
+}
+
+// Add a KV pair, a nil val is a tombstone. Keys must be strictly ascending.
+func (w *Writer) Add(key string, val []byte) error {
+	if w.count > 0 && key <= w.lastKey {
+		return fmt.Errorf("%w: %q after %q", ErrUnsorted, key, w.lastKey)
+	}
+	if uint64(len(key)) > math.MaxUint32 || uint64(len(val)) >= uint64(tombstoneLen) {
+		return ErrTooLarge
+	}
+	pairSize := 2*lenSize + len(key) + len(val)
+	if !w.block.empty() && w.block.size()+lenSize+pairSize > blockSize {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	w.block.add(key, val)
+	if w.count == 0 {
+		w.props.MinKey = key
+	}
+	if val == nil {
+		w.props.Tombstones++
+	}
+	if w.opts.BitsPerKey > 0 {
+		w.hashes = append(w.hashes, bloomHash(key))
+	}
+	w.count++
+	w.lastKey = key
+	return nil
+}
+
+func (w *Writer) flushBlock() error {
+	block := w.block.encode()
+	w.props.RawDataSize += uint64(len(block))
+	stored := compressBlock(w.opts.Compression, block)
+	if w.version >= checksumVersion {
+		stored = appendChecksum(stored)
+	}
+	entry := indexEntry{firstKey: w.block.firstKey, offset: w.offset, size: uint32(len(stored))}
+	if err := w.write(stored); err != nil {
+		return err
+	}
+	w.index = append(w.index, entry)
+	w.block.reset()
+	return nil
+}
+
+// the byte size of the table so far, the data block being built included
+func (w *Writer) Size() uint64 {
+	return w.offset + uint64(w.block.size())
+}
+
+func (w *Writer) AddRangeTombstone(start, end string) {
+	w.rangeTombstones = append(w.rangeTombstones, memtable.RangeTombstone{Start: start, End: end})
+}
+
+// Write the last data block, the range tombstones, the filter, the properties, the index
+// block, their checksum and the footer, then make the table durable at its path.
+func (w *Writer) Finish() error {
+	if err := w.finish(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := os.Rename(w.path+tmpSuffix, w.path); err != nil {
+		os.Remove(w.path + tmpSuffix)
+		return err
+	}
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w *Writer) finish() error {
+	if !w.block.empty() {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+	w.props.DataSize = w.offset
+	index := encodeIndex(w.index)
+	if w.version >= partitionVersion {
+		kind := byte(flatIndex)
+		if len(index) > w.partitionSize() {
+			top, err := w.writePartitions()
+			if err != nil {
+				return err
+			}
+			kind, index = partitionedIndex, encodeIndex(top)
+		}
+		index = append([]byte{kind}, index...)
+	}
+
+	// the range tombstones, the filter, the properties and the index block are checksummed
+	// as a whole
+	meta := []byte{}
+	for _, t := range w.rangeTombstones {
+		meta = append(meta, encodeLens(uint32(len(t.Start)), uint32(len(t.End)))...)
+		meta = append(meta, t.Start...)
+		meta = append(meta, t.End...)
+	}
+	rangeTombstonesOffset := w.offset
+	filterOffset := rangeTombstonesOffset + uint64(len(meta))
+	meta = append(meta, buildFilter(w.hashes, w.opts.BitsPerKey)...)
+	propertiesOffset := rangeTombstonesOffset + uint64(len(meta))
+	if w.version >= propertiesVersion {
+		w.props.MaxKey = w.lastKey
+		w.props.Entries = uint64(w.count)
+		w.props.RangeTombstones = uint64(len(w.rangeTombstones))
+		meta = append(meta, w.props.encode()...)
+	}
+	indexOffset := rangeTombstonesOffset + uint64(len(meta))
+	meta = append(meta, index...)
+	if w.version >= checksumVersion {
+		meta = appendChecksum(meta)
+	}
+	if err := w.write(meta); err != nil {
+		return err
+	}
+	footer := binary.LittleEndian.AppendUint64(nil, rangeTombstonesOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, filterOffset)
+	if w.version >= propertiesVersion {
+		footer = binary.LittleEndian.AppendUint64(footer, propertiesOffset)
+	}
+	footer = binary.LittleEndian.AppendUint64(footer, indexOffset)
+	footer = binary.LittleEndian.AppendUint32(footer, w.count)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(w.rangeTombstones)))
+	footer = binary.LittleEndian.AppendUint32(footer, w.version)
+	footer = binary.LittleEndian.AppendUint64(footer, tableMagic)
+	if err := w.write(footer); err != nil {
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *Writer) partitionSize() int {
+	if w.opts.IndexPartitionSize > 0 {
+		return w.opts.IndexPartitionSize
+	}
+	return defaultIndexPartitionSize
+}
+
+// Cut the index into partitions of about the partition size, write them and return their index.
+func (w *Writer) writePartitions() ([]indexEntry, error) {
+	top := []indexEntry{}
+	for rest := w.index; len(rest) > 0; {
+		n, size := 0, lenSize
+		for n < len(rest) && (n == 0 || size+16+len(rest[n].firstKey) <= w.partitionSize()) {
+			size += 16 + len(rest[n].firstKey)
+			n++
+		}
+		partition := appendChecksum(encodeIndex(rest[:n]))
+		top = append(top, indexEntry{firstKey: rest[0].firstKey, offset: w.offset, size: uint32(len(partition))})
+		if err := w.write(partition); err != nil {
+			return nil, err
+		}
+		rest = rest[n:]
+	}
+	return top, nil
+}
+
+// Give up the table and remove what has been written so far.
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.path + tmpSuffix)
+}
+
+// Write the skiplist being iterated, range tombstones included, to a table at path.
+func WriteSkiplist(path string, it *memtable.MemtableIterator, opts Options) error {
+	w, err := NewWriter(path, opts)
+	if err != nil {
+		return err
+	}
+	for ; it.HasNext(); it.Next() {
+		if err := w.Add(it.Key(), it.Val()); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	for _, t := range it.RangeTombstones() {
+		w.AddRangeTombstone(t.Start, t.End)
+	}
+	return w.Finish()
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,155 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"kv/internal/memtable"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type entry struct {
+	key string
+	val []byte
+}
+
+// check that the table holds exactly the expected KV pairs and range tombstones
+func checkTable(t *testing.T, path string, entries []entry, rangeTombstones []memtable.RangeTombstone) {
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	for _, e := range entries {
+		val, found, err := r.Get(e.key, nil)
+		assert.NoError(t, err)
+		assert.True(t, found, e.key)
+		assert.Equal(t, e.val, val, e.key)
+	}
+	assert.Equal(t, len(rangeTombstones), len(r.rangeTombstones))
+	for _, rt := range rangeTombstones {
+		assert.True(t, r.RangeDeleted(rt.Start))
+		assert.False(t, r.RangeDeleted(rt.End))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add("a", []byte("1")))
+	assert.NoError(t, w.Add("b", nil))
+	assert.NoError(t, w.Add("c", []byte{}))
+	assert.ErrorIs(t, w.Add("c", []byte("dup")), ErrUnsorted)
+	assert.ErrorIs(t, w.Add("a", []byte("back")), ErrUnsorted)
+	w.AddRangeTombstone("x", "z")
+	// nothing shows up at the path before Finish
+	assert.NoFileExists(t, path)
+	assert.NoError(t, w.Finish())
+	assert.NoFileExists(t, path+tmpSuffix)
+
+	checkTable(t, path, []entry{{"a", []byte("1")}, {"b", nil}, {"c", []byte{}}},
+		[]memtable.RangeTombstone{{Start: "x", End: "z"}})
+}
+
+func TestWriterBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	entries := []entry{}
+	for i := 0; i < 100; i++ {
+		e := entry{key: fmt.Sprintf("key-%03d", i), val: make([]byte, 100)}
+		// a value larger than a block gets a block of its own
+		if i == 50 {
+			e.val = make([]byte, 3*blockSize)
+		}
+		entries = append(entries, e)
+		assert.NoError(t, w.Add(e.key, e.val))
+	}
+	assert.NoError(t, w.Finish())
+
+	r, err := Open(path)
+	assert.NoError(t, err)
+	defer r.Close()
+	for i, entry := range r.index {
+		if entry.firstKey == "key-050" {
+			assert.Greater(t, entry.size, uint32(3*blockSize))
+			assert.Equal(t, "key-051", r.index[i+1].firstKey)
+		} else {
+			assert.LessOrEqual(t, entry.size, uint32(blockSize), i)
+		}
+	}
+	checkTable(t, path, entries, nil)
+}
+
+func TestWriterCompression(t *testing.T) {
+	dir := t.TempDir()
+	entries := []entry{}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, entry{key: fmt.Sprintf("key-%03d", i), val: bytes.Repeat([]byte("compressible"), 10)})
+	}
+	// random vals do not shrink, so their blocks are stored uncompressed in the same table
+	random := make([]byte, blockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	entries = append(entries, entry{key: "random", val: random})
+
+	sizes := []int64{}
+	for _, compression := range []Compression{NoCompression, FlateCompression} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.sst", compression+1))
+		w, err := NewWriter(path, Options{Compression: compression})
+		assert.NoError(t, err)
+		for _, e := range entries {
+			assert.NoError(t, w.Add(e.key, e.val))
+		}
+		assert.NoError(t, w.Finish())
+		checkTable(t, path, entries, nil)
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		sizes = append(sizes, info.Size())
+	}
+	assert.Less(t, sizes[1], sizes[0]-int64(blockSize))
+}
+
+func TestWriterAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, Options{BitsPerKey: 10})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Add("a", []byte("1")))
+	w.Abort()
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, path+tmpSuffix)
+}
+
+func TestWriteSkiplist(t *testing.T) {
+	mt := memtable.NewMemtable(memtable.DefaultSkipListThreshold, memtable.DefaultSkipListHeight, 1)
+	mt.Update("b", []byte("1"))
+	mt.Update("a", []byte("2"))
+	mt.Delete("c")
+	// a range tombstone freezes the non-empty mutable skiplist
+	mt.DeleteRange("x", "z")
+	mt.Update("d", []byte("3"))
+	mt.DeleteRange("m", "n")
+
+	dir := t.TempDir()
+	for i, expected := range []struct {
+		entries         []entry
+		rangeTombstones []memtable.RangeTombstone
+	}{
+		{[]entry{{"a", []byte("2")}, {"b", []byte("1")}, {"c", nil}}, nil},
+		{[]entry{{"d", []byte("3")}}, []memtable.RangeTombstone{{Start: "x", End: "z"}}},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.sst", i))
+		flushed, err := mt.FlushLast(func(it *memtable.MemtableIterator) error {
+			return WriteSkiplist(path, it, Options{BitsPerKey: 10})
+		})
+		assert.NoError(t, err)
+		assert.True(t, flushed)
+		checkTable(t, path, expected.entries, expected.rangeTombstones)
+	}
+	// only the mutable skiplist is left
+	flushed, err := mt.FlushLast(func(*memtable.MemtableIterator) error { return nil })
+	assert.NoError(t, err)
+	assert.False(t, flushed)
+}
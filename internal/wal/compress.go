@@ -0,0 +1,55 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// how record payloads are compressed, every record carries its own so mixed logs replay fine
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	// DEFLATE of the standard library
+	FlateCompression
+)
+
+const (
+	// payloads shorter than this are stored as is, compressing them hardly pays off
+	minCompressSize = 256
+)
+
+/*
+Compress the payload with c, and return the compression actually applied: a payload that is
+too short or does not shrink is stored uncompressed.
+*/
+func compress(c Compression, payload []byte) (Compression, []byte) {
+	if c == NoCompression || len(payload) < minCompressSize {
+		return NoCompression, payload
+	}
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	writer.Write(payload)
+	writer.Close()
+	if buf.Len() >= len(payload) {
+		return NoCompression, payload
+	}
+	return FlateCompression, buf.Bytes()
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return data, nil
+	case FlateCompression:
+		payload, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return payload, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %d", ErrCorrupt, c)
+	}
+}
@@ -0,0 +1,16 @@
+package wal
+
+import (
+	"os"
+)
+
+// SyncFunc makes the data written to a file durable.
+type SyncFunc func(file *os.File) error
+
+/*
+Flush the data and the metadata of the file. On macOS the Go runtime issues F_FULLFSYNC,
+which flushes the drive cache as well, a plain fsync there only hands the data to the drive.
+*/
+func Fsync(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,28 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	syncFileRangeWaitBefore = 1
+	syncFileRangeWrite      = 2
+	syncFileRangeWaitAfter  = 4
+)
+
+// Flush the data of the file and only the metadata needed to read it back, such as its size.
+func Fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
+
+/*
+Write back the dirty pages of the file and wait for them. It neither flushes the metadata
+nor the drive cache, so a power loss may still lose appended records: it trades durability
+for latency and only guards against process crashes reliably.
+*/
+func SyncFileRange(file *os.File) error {
+	return syscall.SyncFileRange(int(file.Fd()), 0, 0, syncFileRangeWaitBefore|syncFileRangeWrite|syncFileRangeWaitAfter)
+}
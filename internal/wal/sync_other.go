@@ -0,0 +1,17 @@
+//go:build !linux
+
+package wal
+
+import (
+	"os"
+)
+
+// fdatasync is Linux only, fall back to a full fsync elsewhere.
+func Fdatasync(file *os.File) error {
+	return Fsync(file)
+}
+
+// sync_file_range is Linux only, fall back to a full fsync elsewhere.
+func SyncFileRange(file *os.File) error {
+	return Fsync(file)
+}
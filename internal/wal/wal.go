@@ -0,0 +1,405 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+The write-ahead log of the memtable. Every mutation is appended to the log before it is
+applied to the skiplists, and the log is replayed into an empty memtable on startup, so
+that a restart does not lose what has not been flushed yet.
+Records are opaque to the log, encoding and decoding mutations is up to the caller.
+
+The log is a sequence of segment files named by an increasing number. Only the latest one
+is appended to, it is rolled over to a new segment once it reaches the segment size. A
+record never straddles 2 segments.
+
+A record layout:
+| checksum | payload_len | compression | payload |
+|    4B    |     4B      |     1B      |   ...   |
+where checksum is the CRC32C of everything behind it, so that replay detects torn and
+corrupted records instead of handing garbage to the caller. payload_len is the length of
+the payload as stored, that is after compression.
+*/
+
+const (
+	segmentSuffix = ".log"
+	headerSize    = 9
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupt = errors.New("wal: corrupt record")
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%06d%s", seq, segmentSuffix)
+}
+
+// the numbers of all segments in dir, ascending
+func segments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := []uint64{}
+	for _, entry := range entries {
+		var seq uint64
+		if entry.IsDir() || filepath.Ext(entry.Name()) != segmentSuffix {
+			continue
+		}
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+segmentSuffix, &seq); err != nil || entry.Name() != segmentName(seq) {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+type Options struct {
+	// the byte size at which the active segment is rolled over to a new one
+	SegmentSize uint32
+	Sync        SyncFunc
+	Compression Compression
+}
+
+type Writer struct {
+	dir  string
+	opts Options
+
+	file *os.File
+	// the number and byte size of the active segment
+	seq  uint64
+	size uint32
+	// whether records were appended since the last sync
+	dirty bool
+}
+
+/*
+Start a new segment in dir behind the existing ones, segments left from previous runs are
+never appended to. An empty last segment is taken over instead, so that reopening an idle
+DB does not pile up empty segments.
+*/
+func NewWriter(dir string, opts Options) (*Writer, error) {
+	seqs, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{dir: dir, opts: opts}
+	next := uint64(1)
+	if len(seqs) > 0 {
+		last := seqs[len(seqs)-1]
+		info, err := os.Stat(filepath.Join(dir, segmentName(last)))
+		if err != nil {
+			return nil, err
+		}
+		next = last + 1
+		if info.Size() == 0 {
+			next = last
+		}
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) openSegment(seq uint64) error {
+	file, err := os.OpenFile(filepath.Join(w.dir, segmentName(seq)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// make the directory entry of the new segment durable as well
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.seq, w.size, w.dirty = file, seq, 0, false
+	return nil
+}
+
+/*
+Seal the active segment and start a new one, so that what is appended from now on can be
+removed apart from what came before. An empty active segment is kept as it is.
+*/
+func (w *Writer) Rotate() error {
+	if w.size == 0 {
+		return nil
+	}
+	return w.rotate()
+}
+
+// the number of the active segment
+func (w *Writer) Seq() uint64 {
+	return w.seq
+}
+
+/*
+Remove all segments numbered below seq, once the data they hold has been persisted
+elsewhere. The active segment is never removed.
+*/
+func (w *Writer) RemoveBefore(seq uint64) error {
+	seqs, err := segments(w.dir)
+	if err != nil {
+		return err
+	}
+	removed := false
+	for _, s := range seqs {
+		if s >= seq || s >= w.seq {
+			break
+		}
+		if err := os.Remove(filepath.Join(w.dir, segmentName(s))); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(w.dir)
+}
+
+func (w *Writer) rotate() error {
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(w.seq + 1)
+}
+
+/*
+Append a record with a single write call. If sync is set, the record is fsynced before
+Append returns, otherwise it is left to a later Sync or to the OS when the record reaches
+the disk.
+*/
+func (w *Writer) Append(payload []byte, sync bool) error {
+	if w.size >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	compression, stored := compress(w.opts.Compression, payload)
+	record := make([]byte, headerSize, headerSize+len(stored))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(stored)))
+	record[8] = byte(compression)
+	record = append(record, stored...)
+	binary.LittleEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	w.size += uint32(len(record))
+	w.dirty = true
+	if sync {
+		return w.Sync()
+	}
+	return nil
+}
+
+// Make all appended records durable, it is a no-op if there is nothing new to sync.
+func (w *Writer) Sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.opts.Sync(w.file); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *Writer) Close() error {
+	if err := w.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// how far a replay has got
+type Progress struct {
+	Records uint64
+	Bytes   int64
+	// the byte size of all segments
+	TotalBytes int64
+}
+
+const (
+	// the number of bytes between 2 progress reports within a segment
+	progressInterval = 1024 * 1024
+)
+
+/*
+Feed the payload of every record in dir to apply, in the order they were appended. An empty
+log has nothing to replay. A record cut short by the end of its segment or failing its
+checksum is reported as ErrCorrupt.
+A crash in the middle of an append leaves a torn record behind at the end of the last
+segment. Unless strict is set, a corrupt record in the last segment with no valid record
+anywhere behind it is taken for such a torn tail: the segment is truncated right before it
+and replay succeeds. A corrupt record followed by valid ones is damage to acknowledged
+writes, it is reported as ErrCorrupt either way.
+If progress is not nil, it is called every progressInterval bytes and at the end of every
+segment.
+*/
+func Replay(dir string, strict bool, progress func(Progress), apply func([]byte) error) error {
+	seqs, err := segments(dir)
+	if err != nil {
+		return err
+	}
+	r := &replayer{progress: progress, apply: apply}
+	for _, seq := range seqs {
+		info, err := os.Stat(filepath.Join(dir, segmentName(seq)))
+		if err != nil {
+			return err
+		}
+		r.TotalBytes += info.Size()
+	}
+	for i, seq := range seqs {
+		path := filepath.Join(dir, segmentName(seq))
+		end, err := r.replaySegment(path)
+		if errors.Is(err, ErrCorrupt) && !strict && i == len(seqs)-1 {
+			valid, validErr := validRecordAfter(path, end)
+			if validErr != nil {
+				return validErr
+			}
+			if valid {
+				return err
+			}
+			r.TotalBytes -= r.segmentSize - end
+			r.report()
+			return truncate(path, end)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type replayer struct {
+	Progress
+	progress func(Progress)
+	apply    func([]byte) error
+	// the byte size of the segment being replayed
+	segmentSize int64
+	// the replayed bytes at the last report
+	reported int64
+}
+
+func (r *replayer) report() {
+	if r.progress != nil {
+		r.progress(r.Progress)
+	}
+	r.reported = r.Bytes
+}
+
+// replay a segment and return the offset behind the last record applied
+func (r *replayer) replaySegment(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r.segmentSize = info.Size()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+	for offset := int64(0); ; {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			r.report()
+			return offset, nil
+		} else if err != nil {
+			return offset, readErr(err, path, offset)
+		}
+		storedLen := int64(binary.LittleEndian.Uint32(header[4:]))
+		// a torn length must not make us allocate past the end of the segment
+		if offset+headerSize+storedLen > info.Size() {
+			return offset, readErr(io.ErrUnexpectedEOF, path, offset)
+		}
+		stored := make([]byte, storedLen)
+		if _, err := io.ReadFull(reader, stored); err != nil {
+			return offset, readErr(err, path, offset)
+		}
+		crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, stored)
+		if crc != binary.LittleEndian.Uint32(header) {
+			return offset, fmt.Errorf("%w: checksum mismatch at offset %d of %s", ErrCorrupt, offset, filepath.Base(path))
+		}
+		payload, err := decompress(Compression(header[8]), stored)
+		if err != nil {
+			return offset, fmt.Errorf("%w at offset %d of %s", err, offset, filepath.Base(path))
+		}
+		if err := r.apply(payload); err != nil {
+			return offset, err
+		}
+		offset += int64(headerSize + len(stored))
+		r.Records++
+		r.Bytes += int64(headerSize + len(stored))
+		if r.Bytes-r.reported >= progressInterval {
+			r.report()
+		}
+	}
+}
+
+/*
+Whether a valid record starts anywhere behind offset in the segment. Every byte offset is
+tried, since the length of the corrupt record at offset cannot be trusted to find the next
+one. Zeroed or torn bytes fail the checksum.
+*/
+func validRecordAfter(path string, offset int64) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	for start := offset + 1; start+headerSize <= int64(len(data)); start++ {
+		header := data[start : start+headerSize]
+		end := start + headerSize + int64(binary.LittleEndian.Uint32(header[4:]))
+		if end > int64(len(data)) {
+			continue
+		}
+		if crc32.Checksum(data[start+4:end], crcTable) == binary.LittleEndian.Uint32(header) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func truncate(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func readErr(err error, path string, offset int64) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated record at offset %d of %s", ErrCorrupt, offset, filepath.Base(path))
+	}
+	return err
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,329 @@
+package wal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func replayAll(t *testing.T, dir string) ([][]byte, error) {
+	payloads := [][]byte{}
+	err := Replay(dir, true, nil, func(payload []byte) error {
+		payloads = append(payloads, payload)
+		return nil
+	})
+	return payloads, err
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	payloads, err := replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Empty(t, payloads)
+
+	w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append([]byte("first"), true))
+	assert.NoError(t, w.Append([]byte{}, false))
+	assert.NoError(t, w.Close())
+
+	// reopening starts a new segment behind the existing one
+	w, err = NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append([]byte("second"), false))
+	assert.NoError(t, w.Close())
+	seqs, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, seqs)
+
+	payloads, err = replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("first"), {}, []byte("second")}, payloads)
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	// each record takes 9 + 12 bytes, so a segment is rolled over every 2 records
+	w, err := NewWriter(dir, Options{SegmentSize: 32, Sync: Fsync})
+	assert.NoError(t, err)
+	expected := [][]byte{}
+	for i := 0; i < 7; i++ {
+		payload := []byte("payload-" + string(rune('a'+i)) + "xyz")
+		expected = append(expected, payload)
+		assert.NoError(t, w.Append(payload, false))
+	}
+	assert.NoError(t, w.Close())
+
+	seqs, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3, 4}, seqs)
+	payloads, err := replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, payloads)
+
+	// foreign files are not taken for segments
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.log"), []byte("junk"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "000009.tmp"), []byte("junk"), 0644))
+	seqs, err = segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3, 4}, seqs)
+}
+
+func TestReopenEmptySegment(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+	}
+	seqs, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, seqs)
+}
+
+func TestReplayTruncated(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append([]byte("first"), false))
+	assert.NoError(t, w.Append([]byte("second"), false))
+	assert.NoError(t, w.Close())
+
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	for _, cut := range []int64{1, 8} {
+		assert.NoError(t, os.Truncate(path, info.Size()-cut))
+		payloads, err := replayAll(t, dir)
+		assert.ErrorIs(t, err, ErrCorrupt)
+		assert.Equal(t, [][]byte{[]byte("first")}, payloads)
+	}
+}
+
+func TestReplayChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append([]byte("first"), false))
+	assert.NoError(t, w.Append([]byte("second"), false))
+	assert.NoError(t, w.Close())
+
+	path := filepath.Join(dir, segmentName(1))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	// flip a payload byte of the 2nd record
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	payloads, err := replayAll(t, dir)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.Equal(t, [][]byte{[]byte("first")}, payloads)
+
+	// a torn length pointing past the end of the segment
+	data[len(data)-1] ^= 0xff
+	data[headerSize+len("first")+7] = 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	payloads, err = replayAll(t, dir)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.Equal(t, [][]byte{[]byte("first")}, payloads)
+}
+
+func TestSyncFunc(t *testing.T) {
+	for _, sync := range []SyncFunc{Fsync, Fdatasync, SyncFileRange} {
+		dir := t.TempDir()
+		syncs := 0
+		w, err := NewWriter(dir, Options{SegmentSize: 32, Sync: func(file *os.File) error {
+			syncs++
+			return sync(file)
+		}})
+		assert.NoError(t, err)
+		assert.NoError(t, w.Append([]byte("payload-xyz-"), true))
+		assert.NoError(t, w.Append([]byte("payload-xyz-"), false))
+		assert.Equal(t, 1, syncs)
+		// rolling over syncs the sealed segment
+		assert.NoError(t, w.Append([]byte("payload-xyz-"), false))
+		assert.Equal(t, 2, syncs)
+		assert.NoError(t, w.Sync())
+		assert.Equal(t, 3, syncs)
+		// nothing new to sync
+		assert.NoError(t, w.Sync())
+		assert.Equal(t, 3, syncs)
+		assert.NoError(t, w.Append([]byte("payload-xyz-"), false))
+		assert.NoError(t, w.Close())
+		assert.Equal(t, 4, syncs)
+
+		payloads, err := replayAll(t, dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, len(payloads))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("compressible"), 100)
+	w, err := NewWriter(dir, Options{SegmentSize: 1 << 20, Sync: Fsync, Compression: FlateCompression})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append(large, false))
+	// too short to be compressed
+	assert.NoError(t, w.Append([]byte("short"), false))
+	assert.NoError(t, w.Close())
+	info, err := os.Stat(filepath.Join(dir, segmentName(1)))
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(len(large)))
+
+	// a log mixing compressed and uncompressed records replays fine
+	w, err = NewWriter(dir, Options{SegmentSize: 1 << 20, Sync: Fsync})
+	assert.NoError(t, err)
+	assert.NoError(t, w.Append(large, false))
+	assert.NoError(t, w.Close())
+	payloads, err := replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{large, []byte("short"), large}, payloads)
+}
+
+func TestReplayTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 32, Sync: Fsync})
+	assert.NoError(t, err)
+	for _, payload := range []string{"first-record", "second-record", "third-record"} {
+		assert.NoError(t, w.Append([]byte(payload), false))
+	}
+	assert.NoError(t, w.Close())
+	seqs, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, seqs)
+
+	last := filepath.Join(dir, segmentName(2))
+	info, err := os.Stat(last)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(last, info.Size()-1))
+	_, err = replayAll(t, dir)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	payloads := [][]byte{}
+	err = Replay(dir, false, nil, func(payload []byte) error {
+		payloads = append(payloads, payload)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("first-record"), []byte("second-record")}, payloads)
+	// the torn record is cut off, so strict replay succeeds from now on
+	info, err = os.Stat(last)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+	payloads, err = replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(payloads))
+
+	// a corrupt record in an earlier segment is never tolerated
+	first := filepath.Join(dir, segmentName(1))
+	info, err = os.Stat(first)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(first, info.Size()-1))
+	err = Replay(dir, false, nil, func([]byte) error { return nil })
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestReplayCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	for _, payload := range []string{"first", "second", "third"} {
+		assert.NoError(t, w.Append([]byte(payload), false))
+	}
+	assert.NoError(t, w.Close())
+
+	path := filepath.Join(dir, segmentName(1))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	second := headerSize + len("first")
+	// a flipped payload byte and a flipped length of the 2nd record, with the 3rd one intact
+	for _, at := range []int{second + headerSize, second + 4} {
+		corrupt := append([]byte{}, data...)
+		corrupt[at] ^= 0x01
+		assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+		payloads := [][]byte{}
+		err = Replay(dir, false, nil, func(payload []byte) error {
+			payloads = append(payloads, payload)
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrCorrupt)
+		assert.Equal(t, [][]byte{[]byte("first")}, payloads)
+		// nothing is cut off
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+	}
+
+	// the same damage to the last record is a torn tail
+	third := second + headerSize + len("second")
+	corrupt := append([]byte{}, data...)
+	corrupt[third+headerSize] ^= 0x01
+	assert.NoError(t, os.WriteFile(path, corrupt, 0644))
+	assert.NoError(t, Replay(dir, false, nil, func([]byte) error { return nil }))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(third), info.Size())
+}
+
+func TestReplayProgress(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 32, Sync: Fsync})
+	assert.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, w.Append([]byte("payload-xyz-"), false))
+	}
+	assert.NoError(t, w.Close())
+
+	reports := []Progress{}
+	err = Replay(dir, true, func(progress Progress) {
+		reports = append(reports, progress)
+	}, func([]byte) error { return nil })
+	assert.NoError(t, err)
+	// one report per segment, 2 records of 9 + 12 bytes fit into a segment
+	assert.Equal(t, []Progress{
+		{Records: 2, Bytes: 42, TotalBytes: 105},
+		{Records: 4, Bytes: 84, TotalBytes: 105},
+		{Records: 5, Bytes: 105, TotalBytes: 105},
+	}, reports)
+
+	// a torn tail does not count towards the total
+	assert.NoError(t, os.Truncate(filepath.Join(dir, segmentName(3)), 20))
+	reports = reports[:0]
+	err = Replay(dir, false, func(progress Progress) {
+		reports = append(reports, progress)
+	}, func([]byte) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, Progress{Records: 4, Bytes: 84, TotalBytes: 84}, reports[len(reports)-1])
+}
+
+func TestRotateRemoveBefore(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, Options{SegmentSize: 1024, Sync: Fsync})
+	assert.NoError(t, err)
+	// an empty segment is not rotated
+	assert.NoError(t, w.Rotate())
+	assert.Equal(t, uint64(1), w.Seq())
+	for _, payload := range []string{"first", "second", "third"} {
+		assert.NoError(t, w.Append([]byte(payload), false))
+		assert.NoError(t, w.Rotate())
+	}
+	assert.Equal(t, uint64(4), w.Seq())
+
+	assert.NoError(t, w.RemoveBefore(3))
+	seqs, err := segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 4}, seqs)
+	payloads, err := replayAll(t, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("third")}, payloads)
+
+	// the active segment survives
+	assert.NoError(t, w.RemoveBefore(10))
+	seqs, err = segments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4}, seqs)
+	assert.NoError(t, w.Close())
+}
@@ -0,0 +1,73 @@
+package kv
+
+/*
+Flushes and compactions run as background jobs, at most MaxBackgroundJobs at a time. Jobs
+are scheduled whenever a skiplist is frozen, a table is added to L0 and a job finishes, so
+no goroutine idles waiting for work. One flush runs at a time, since skiplists are flushed
+oldest first, while compactions run side by side on disjoint tables. Compactions leave a
+slot free for the flush if there is more than one. The first error of a job stops
+scheduling, it is returned by Close.
+*/
+
+func (db *DB) scheduleJobs() {
+	db.jobsMutex.Lock()
+	defer db.jobsMutex.Unlock()
+	db.scheduleJobsLocked()
+}
+
+func (db *DB) scheduleJobsLocked() {
+	if db.jobsClosed || db.jobsErr != nil {
+		return
+	}
+	if !db.flushing && db.jobs < db.opts.MaxBackgroundJobs && db.mt.Len() > 1 {
+		db.flushing = true
+		db.startJob(db.flushInBackground, func() { db.flushing = false })
+	}
+	// deterministic compactions run right after the flushes, see compactAll
+	for !db.opts.DeterministicCompaction &&
+		db.jobs < db.opts.MaxBackgroundJobs && db.compactions < max(1, db.opts.MaxBackgroundJobs-1) {
+		task := db.pickCompaction()
+		if task == nil {
+			return
+		}
+		db.compactions++
+		for _, t := range task.inputs {
+			db.compacting[t.meta.Num] = true
+		}
+		db.startJob(func() error { return db.compact(task) }, func() {
+			db.compactions--
+			for _, t := range task.inputs {
+				delete(db.compacting, t.meta.Num)
+			}
+		})
+	}
+}
+
+// Run job in a goroutine of its own, done is called under jobsMutex once it is over.
+func (db *DB) startJob(job func() error, done func()) {
+	db.jobs++
+	db.jobsDone.Add(1)
+	go func() {
+		defer db.jobsDone.Done()
+		err := job()
+
+		db.jobsMutex.Lock()
+		defer db.jobsMutex.Unlock()
+		db.jobs--
+		done()
+		if err != nil && db.jobsErr == nil {
+			db.jobsErr = err
+		}
+		db.scheduleJobsLocked()
+	}()
+}
+
+// Stop scheduling jobs and wait for the ones running, return the first error of a job.
+func (db *DB) stopJobs() error {
+	db.jobsMutex.Lock()
+	db.jobsClosed = true
+	db.jobsMutex.Unlock()
+
+	db.jobsDone.Wait()
+	return db.jobsErr
+}
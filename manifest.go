@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+The MANIFEST in the table directory lists the tables of every level and the number of the
+next table, one line each:
+
+	next 12
+	11 10 9
+	3 5 7
+
+The first level line is L0, newest first, every other level lists its tables in key order.
+The MANIFEST is rewritten as a whole to a temporary file and renamed over the old one
+whenever the levels change, so a crash leaves either the old or the new one. Table files it
+does not list are leftovers of a flush or a compaction cut short.
+*/
+
+const manifestName = "MANIFEST"
+
+type manifest struct {
+	next   uint64
+	levels [][]uint64
+}
+
+// read the MANIFEST in dir, nil if there is none
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	m := &manifest{}
+	if _, err := fmt.Sscanf(lines[0], "next %d", &m.next); err != nil {
+		return nil, fmt.Errorf("%w: MANIFEST: %v", ErrCorrupt, err)
+	}
+	for _, line := range lines[1:] {
+		nums := []uint64{}
+		for _, field := range strings.Fields(line) {
+			num, err := strconv.ParseUint(field, 10, 64)
+			if err != nil || num >= m.next {
+				return nil, fmt.Errorf("%w: MANIFEST: bad table %q", ErrCorrupt, field)
+			}
+			nums = append(nums, num)
+		}
+		m.levels = append(m.levels, nums)
+	}
+	return m, nil
+}
+
+func writeManifest(dir string, m *manifest) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "next %d\n", m.next)
+	for _, nums := range m.levels {
+		fields := make([]string, len(nums))
+		for i, num := range nums {
+			fields[i] = strconv.FormatUint(num, 10)
+		}
+		b.WriteString(strings.Join(fields, " ") + "\n")
+	}
+
+	path := filepath.Join(dir, manifestName)
+	file, err := os.OpenFile(path+tmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(b.String()); err != nil {
+		file.Close()
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		os.Remove(path + tmpSuffix)
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,341 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"kv/internal/compaction"
+	"kv/internal/memtable"
+	"kv/internal/sstable"
+	"kv/internal/wal"
+	"path/filepath"
+	"time"
+)
+
+var ErrInvalidOptions = errors.New("kv: invalid options")
+
+type SyncPolicy int
+
+const (
+	// fsync the WAL before acknowledging every write
+	SyncAlways SyncPolicy = iota
+	// leave flushing the WAL to the OS, an OS crash or power loss loses what it has not
+	// written back yet
+	SyncNever
+	// fsync the WAL in the background every SyncInterval. An OS crash or power loss loses
+	// the writes since the last sync that went through, about one interval unless syncs
+	// fail or the ticker waits long for the writers. A crash of the process loses nothing
+	SyncPeriodic
+)
+
+// the system call used to make the WAL durable
+type SyncMethod int
+
+const (
+	// fsync, on macOS it is F_FULLFSYNC which flushes the drive cache as well
+	SyncFsync SyncMethod = iota
+	// fdatasync on Linux, fsync elsewhere
+	SyncFdatasync
+	// sync_file_range on Linux, fsync elsewhere. It leaves the metadata and the drive cache
+	// unflushed, so it only survives process crashes reliably, not power loss
+	SyncFileRange
+)
+
+func (opts *Options) walDir(path string) string {
+	if opts.WALDir != "" {
+		return opts.WALDir
+	}
+	return filepath.Join(path, opts.WALSubdir)
+}
+
+func (opts *Options) walOptions() wal.Options {
+	compression := wal.NoCompression
+	if opts.WALCompression == FlateCompression {
+		compression = wal.FlateCompression
+	}
+	return wal.Options{
+		SegmentSize: opts.WALSegmentSize,
+		Sync:        opts.SyncMethod.syncFunc(),
+		Compression: compression,
+	}
+}
+
+func (opts *Options) tableOptions() sstable.Options {
+	compression := sstable.NoCompression
+	if opts.TableCompression == FlateCompression {
+		compression = sstable.FlateCompression
+	}
+	return sstable.Options{BitsPerKey: opts.BloomBitsPerKey, Compression: compression}
+}
+
+func (opts *Options) compactionOptions() compaction.Options {
+	return compaction.Options{
+		Style:           compaction.Style(opts.CompactionStyle),
+		L0Trigger:       opts.L0CompactionTrigger,
+		BaseLevelSize:   opts.BaseLevelSize,
+		LevelMultiplier: opts.LevelSizeMultiplier,
+		TargetTableSize: opts.TargetTableSize,
+		Levels:          opts.NumLevels,
+		MinOverlap:      opts.DeterministicCompaction,
+	}
+}
+
+func (method SyncMethod) syncFunc() wal.SyncFunc {
+	switch method {
+	case SyncFdatasync:
+		return wal.Fdatasync
+	case SyncFileRange:
+		return wal.SyncFileRange
+	default:
+		return wal.Fsync
+	}
+}
+
+// how far Open has got replaying the WAL, in records and bytes
+type ReplayProgress = wal.Progress
+
+// how tables are compacted
+type CompactionStyle int
+
+const (
+	// a sorted run per level, see package compaction
+	CompactionLeveled CompactionStyle = iota
+	// all tables in L0, tables of similar size are merged. It rewrites data less often than
+	// leveled compaction, for write-heavy workloads, but leaves more tables to search
+	CompactionSizeTiered
+)
+
+// how data written to disk is compressed
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	// DEFLATE of the standard library, applied to large payloads only
+	FlateCompression
+)
+
+/*
+Options configures a DB. A nil *Options passed to Open stands for DefaultOptions(), and
+zero fields of a non-nil *Options are filled with their defaults.
+*/
+type Options struct {
+	// the byte size at which the mutable skiplist is frozen and a new one is created
+	MemtableThreshold uint32
+	// the number of layers of each skiplist
+	MaxSkiplistHeight uint8
+	// when writes are made durable
+	SyncPolicy SyncPolicy
+	// how writes are made durable
+	SyncMethod SyncMethod
+	// how often the WAL is fsynced under SyncPeriodic
+	SyncInterval time.Duration
+	// the byte size at which the active WAL segment is rolled over to a new one
+	WALSegmentSize uint32
+	// refuse to open when the WAL ends with a torn record instead of truncating it, a torn
+	// record is left behind by a crash in the middle of a write
+	StrictWALRecovery bool
+	// called from Open every MiB of WAL replayed and at the end of every segment, so that
+	// applications can surface the progress of a long startup
+	OnReplayProgress func(ReplayProgress)
+	// how WAL records are compressed, it can be changed between runs since every record
+	// carries its own compression
+	WALCompression Compression
+	// the subdirectories of the DB directory holding the WAL and the table files
+	WALSubdir   string
+	TableSubdir string
+	// a directory outside of the DB directory to keep the WAL in instead of WALSubdir, for
+	// example on a faster device than the table files. It must not be shared between DBs
+	WALDir string
+	// the bits of the bloom filter spent on each key of a table, about 1% of the lookups of
+	// absent keys read a block at 10 bits. A negative value writes tables without filters
+	BloomBitsPerKey int
+	// how the data blocks of new tables are compressed, it can be changed between runs since
+	// every block carries its own compression
+	TableCompression Compression
+	// how tables are compacted, it can be changed between runs
+	CompactionStyle CompactionStyle
+	// the number of L0 tables, the ones flushed from the memtable, that triggers a compaction
+	L0CompactionTrigger int
+	// the target byte size of L1, every level below is LevelSizeMultiplier times larger
+	BaseLevelSize       uint64
+	LevelSizeMultiplier int
+	// the byte size at which leveled compactions cut their output tables
+	TargetTableSize uint64
+	// the number of levels, L0 included, at least 2. Lowering it between runs leaves the
+	// levels beyond in place, they are just no longer compacted
+	NumLevels int
+	// the number of flushes and compactions run concurrently in the background
+	MaxBackgroundJobs int
+	// called by compactions with the newest value of every key they rewrite, it returns the
+	// value to write instead, nil to delete the key, for example to expire records. Keys not
+	// compacted yet are left as they are. It is called concurrently and must not use the DB
+	CompactionFilter func(key string, val []byte) []byte
+	// derive compactions from the tables alone, so that DBs fed the same writes end up with
+	// identical table files. Compactions run one at a time right after each flush instead of
+	// in the background, and DeletePrefix leaves dropping tables to them
+	DeterministicCompaction bool
+	// the bytes per second all compactions together read and write at most, so that they
+	// leave the disk to foreground reads and writes. Zero leaves them unlimited
+	CompactionRateLimit int64
+	// refuse to overwrite keys: a put of an existing key fails with ErrKeyExists and the
+	// whole batch is rejected. Deleted keys may be put again, ingested tables are not checked
+	WriteOnce bool
+}
+
+/*
+ReadOptions configures a single Get, Has or MultiGet. A nil *ReadOptions reads with the
+defaults.
+*/
+type ReadOptions struct {
+	// do not verify the checksums of the table blocks read, so that bit rot goes unnoticed
+	// for a bit of speed
+	SkipChecksums bool
+	// if not nil, the work done by the read is added to it
+	Perf *PerfContext
+}
+
+func (ro *ReadOptions) perf() *PerfContext {
+	if ro == nil {
+		return nil
+	}
+	return ro.Perf
+}
+
+func (ro *ReadOptions) skipChecksums() bool {
+	return ro != nil && ro.SkipChecksums
+}
+
+/*
+WriteOptions configures a single Put, Delete or Write. A nil *WriteOptions follows the
+SyncPolicy of the DB.
+*/
+type WriteOptions struct {
+	// fsync the WAL before acknowledging the write
+	Sync bool
+}
+
+const (
+	defaultSyncInterval    = 100 * time.Millisecond
+	defaultWALSegmentSize  = 64 * 1024 * 1024
+	defaultWALSubdir       = "wal"
+	defaultTableSubdir     = "tables"
+	defaultBloomBitsPerKey = 10
+
+	defaultL0CompactionTrigger = 4
+	defaultBaseLevelSize       = 64 * 1024 * 1024
+	defaultLevelSizeMultiplier = 10
+	defaultTargetTableSize     = 8 * 1024 * 1024
+	defaultNumLevels           = 7
+	defaultMaxBackgroundJobs   = 2
+)
+
+func DefaultOptions() *Options {
+	return &Options{
+		MemtableThreshold: memtable.DefaultSkipListThreshold,
+		MaxSkiplistHeight: memtable.DefaultSkipListHeight,
+		SyncPolicy:        SyncAlways,
+		SyncMethod:        SyncFsync,
+		SyncInterval:      defaultSyncInterval,
+		WALSegmentSize:    defaultWALSegmentSize,
+		WALSubdir:         defaultWALSubdir,
+		TableSubdir:       defaultTableSubdir,
+		BloomBitsPerKey:   defaultBloomBitsPerKey,
+
+		L0CompactionTrigger: defaultL0CompactionTrigger,
+		BaseLevelSize:       defaultBaseLevelSize,
+		LevelSizeMultiplier: defaultLevelSizeMultiplier,
+		TargetTableSize:     defaultTargetTableSize,
+		NumLevels:           defaultNumLevels,
+		MaxBackgroundJobs:   defaultMaxBackgroundJobs,
+	}
+}
+
+// return a copy of opts with zero fields set to their defaults
+func (opts *Options) withDefaults() *Options {
+	defaults := DefaultOptions()
+	if opts == nil {
+		return defaults
+	}
+	copied := *opts
+	if copied.MemtableThreshold == 0 {
+		copied.MemtableThreshold = defaults.MemtableThreshold
+	}
+	if copied.MaxSkiplistHeight == 0 {
+		copied.MaxSkiplistHeight = defaults.MaxSkiplistHeight
+	}
+	if copied.SyncInterval == 0 {
+		copied.SyncInterval = defaults.SyncInterval
+	}
+	if copied.WALSegmentSize == 0 {
+		copied.WALSegmentSize = defaults.WALSegmentSize
+	}
+	if copied.WALSubdir == "" {
+		copied.WALSubdir = defaults.WALSubdir
+	}
+	if copied.TableSubdir == "" {
+		copied.TableSubdir = defaults.TableSubdir
+	}
+	if copied.BloomBitsPerKey == 0 {
+		copied.BloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	if copied.L0CompactionTrigger == 0 {
+		copied.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if copied.BaseLevelSize == 0 {
+		copied.BaseLevelSize = defaults.BaseLevelSize
+	}
+	if copied.LevelSizeMultiplier == 0 {
+		copied.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if copied.TargetTableSize == 0 {
+		copied.TargetTableSize = defaults.TargetTableSize
+	}
+	if copied.NumLevels == 0 {
+		copied.NumLevels = defaults.NumLevels
+	}
+	if copied.MaxBackgroundJobs == 0 {
+		copied.MaxBackgroundJobs = defaults.MaxBackgroundJobs
+	}
+	return &copied
+}
+
+func (opts *Options) validate() error {
+	if opts.SyncPolicy != SyncAlways && opts.SyncPolicy != SyncNever && opts.SyncPolicy != SyncPeriodic {
+		return fmt.Errorf("%w: unknown sync policy %d", ErrInvalidOptions, opts.SyncPolicy)
+	}
+	if opts.SyncMethod != SyncFsync && opts.SyncMethod != SyncFdatasync && opts.SyncMethod != SyncFileRange {
+		return fmt.Errorf("%w: unknown sync method %d", ErrInvalidOptions, opts.SyncMethod)
+	}
+	for _, compression := range []Compression{opts.WALCompression, opts.TableCompression} {
+		if compression != NoCompression && compression != FlateCompression {
+			return fmt.Errorf("%w: unknown compression %d", ErrInvalidOptions, compression)
+		}
+	}
+	if opts.SyncInterval < 0 {
+		return fmt.Errorf("%w: negative sync interval %v", ErrInvalidOptions, opts.SyncInterval)
+	}
+	for _, subdir := range []string{opts.WALSubdir, opts.TableSubdir} {
+		if !filepath.IsLocal(subdir) {
+			return fmt.Errorf("%w: %q is not a subdirectory of the DB directory", ErrInvalidOptions, subdir)
+		}
+	}
+	if opts.CompactionStyle != CompactionLeveled && opts.CompactionStyle != CompactionSizeTiered {
+		return fmt.Errorf("%w: unknown compaction style %d", ErrInvalidOptions, opts.CompactionStyle)
+	}
+	if opts.L0CompactionTrigger < 1 || opts.LevelSizeMultiplier < 1 {
+		return fmt.Errorf("%w: L0 compaction trigger %d and level size multiplier %d must be positive",
+			ErrInvalidOptions, opts.L0CompactionTrigger, opts.LevelSizeMultiplier)
+	}
+	if opts.CompactionRateLimit < 0 {
+		return fmt.Errorf("%w: negative compaction rate limit %d", ErrInvalidOptions, opts.CompactionRateLimit)
+	}
+	if opts.MaxBackgroundJobs < 1 {
+		return fmt.Errorf("%w: %d background jobs, at least 1 is needed", ErrInvalidOptions, opts.MaxBackgroundJobs)
+	}
+	if opts.NumLevels < 2 {
+		return fmt.Errorf("%w: %d levels, at least 2 are needed", ErrInvalidOptions, opts.NumLevels)
+	}
+	if filepath.Clean(opts.WALSubdir) == filepath.Clean(opts.TableSubdir) {
+		return fmt.Errorf("%w: WAL and tables share the subdirectory %q", ErrInvalidOptions, opts.WALSubdir)
+	}
+	return nil
+}
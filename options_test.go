@@ -0,0 +1,208 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"kv/internal/memtable"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	opts := DefaultOptions()
+	assert.Equal(t, uint32(memtable.DefaultSkipListThreshold), opts.MemtableThreshold)
+	assert.Equal(t, memtable.DefaultSkipListHeight, opts.MaxSkiplistHeight)
+	assert.Equal(t, SyncAlways, opts.SyncPolicy)
+	assert.Equal(t, uint32(defaultWALSegmentSize), opts.WALSegmentSize)
+	assert.NoError(t, opts.validate())
+
+	var nilOpts *Options
+	assert.Equal(t, opts, nilOpts.withDefaults())
+	assert.Equal(t, opts, (&Options{}).withDefaults())
+}
+
+func TestOptionsWithDefaults(t *testing.T) {
+	opts := &Options{MemtableThreshold: 1024, SyncPolicy: SyncNever, WALSubdir: "log"}
+	filled := opts.withDefaults()
+	assert.Equal(t, uint32(1024), filled.MemtableThreshold)
+	assert.Equal(t, memtable.DefaultSkipListHeight, filled.MaxSkiplistHeight)
+	assert.Equal(t, SyncNever, filled.SyncPolicy)
+	assert.Equal(t, "log", filled.WALSubdir)
+	assert.Equal(t, defaultTableSubdir, filled.TableSubdir)
+	assert.Equal(t, defaultBloomBitsPerKey, filled.BloomBitsPerKey)
+	// the caller's options are left untouched
+	assert.Zero(t, opts.MaxSkiplistHeight)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	for _, opts := range []*Options{
+		{SyncPolicy: SyncPolicy(42)},
+		{SyncMethod: SyncMethod(42)},
+		{WALCompression: Compression(42)},
+		{TableCompression: Compression(42)},
+		{SyncPolicy: SyncPeriodic, SyncInterval: -time.Second},
+		{WALSubdir: "/abs"},
+		{TableSubdir: "../outside"},
+		{WALSubdir: "same", TableSubdir: "./same"},
+		{CompactionStyle: CompactionStyle(42)},
+		{L0CompactionTrigger: -1},
+		{LevelSizeMultiplier: -2},
+		{NumLevels: 1},
+		{MaxBackgroundJobs: -1},
+		{CompactionRateLimit: -1},
+	} {
+		assert.ErrorIs(t, opts.withDefaults().validate(), ErrInvalidOptions, "%+v", opts)
+		_, err := Open(t.TempDir(), opts)
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, &Options{MemtableThreshold: 64, MaxSkiplistHeight: 2, TableSubdir: "sst"})
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.DirExists(t, filepath.Join(path, defaultWALSubdir))
+	assert.DirExists(t, filepath.Join(path, "sst"))
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, db.Put(key, make([]byte, 40), nil))
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_, err := db.Get(key, nil)
+		assert.NoError(t, err)
+	}
+}
+
+func TestSyncMethods(t *testing.T) {
+	for _, method := range []SyncMethod{SyncFsync, SyncFdatasync, SyncFileRange} {
+		path := t.TempDir()
+		db, err := Open(path, &Options{SyncMethod: method})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put("key", []byte("val"), nil))
+		assert.NoError(t, db.Close())
+
+		db, err = Open(path, nil)
+		assert.NoError(t, err)
+		val, err := db.Get("key", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "val", string(val))
+		assert.NoError(t, db.Close())
+	}
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, &Options{SyncPolicy: SyncPeriodic, SyncInterval: time.Millisecond})
+	assert.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+		time.Sleep(2 * time.Millisecond)
+	}
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		val, err := db.Get(key, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, key, string(val))
+	}
+}
+
+func TestWALCompression(t *testing.T) {
+	path := t.TempDir()
+	val := bytes.Repeat([]byte("compressible"), 100)
+	for _, compression := range []Compression{FlateCompression, NoCompression} {
+		db, err := Open(path, &Options{WALCompression: compression})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put(fmt.Sprint(compression), val, nil))
+		assert.NoError(t, db.Close())
+	}
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	for _, compression := range []Compression{FlateCompression, NoCompression} {
+		got, err := db.Get(fmt.Sprint(compression), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val, got)
+	}
+}
+
+func TestTableCompression(t *testing.T) {
+	path := t.TempDir()
+	val := bytes.Repeat([]byte("compressible"), 100)
+	// every Put freezes the skiplist of the previous one, so the tables mix compressions as
+	// long as they are not compacted
+	for i, compression := range []Compression{FlateCompression, NoCompression, FlateCompression} {
+		db, err := Open(path, &Options{MemtableThreshold: 1, TableCompression: compression, L0CompactionTrigger: 100})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Put(fmt.Sprint(i), val, nil))
+		assert.NoError(t, db.Put(fmt.Sprintf("flush-%d", i), []byte("x"), nil))
+		assert.NoError(t, db.Close())
+	}
+	// the MANIFEST aside
+	assert.GreaterOrEqual(t, len(listDir(t, filepath.Join(path, defaultTableSubdir)))-1, 3)
+
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		got, err := db.Get(fmt.Sprint(i), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, val, got)
+	}
+}
+
+func TestReplayProgress(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, &Options{WALSegmentSize: 64})
+	assert.NoError(t, err)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, db.Put(key, []byte(key), nil))
+	}
+	assert.NoError(t, db.Close())
+
+	var last ReplayProgress
+	reports := 0
+	db, err = Open(path, &Options{OnReplayProgress: func(progress ReplayProgress) {
+		last = progress
+		reports++
+	}})
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Greater(t, reports, 1)
+	assert.Equal(t, uint64(5), last.Records)
+	assert.Equal(t, last.TotalBytes, last.Bytes)
+}
+
+func TestWALDir(t *testing.T) {
+	path, walDir := t.TempDir(), filepath.Join(t.TempDir(), "wal")
+	db, err := Open(path, &Options{WALDir: walDir})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("key", []byte("val"), nil))
+	assert.FileExists(t, filepath.Join(walDir, "000001.log"))
+	assert.NoDirExists(t, filepath.Join(path, defaultWALSubdir))
+
+	// the WAL directory is locked as well
+	_, err = Open(t.TempDir(), &Options{WALDir: walDir})
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, &Options{WALDir: walDir})
+	assert.NoError(t, err)
+	defer db.Close()
+	val, err := db.Get("key", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "val", string(val))
+
+	for _, dir := range []string{path, filepath.Join(path, "wal"), filepath.Join(path, "sub", "..")} {
+		_, err = Open(path, &Options{WALDir: dir})
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+}
@@ -0,0 +1,34 @@
+package kv
+
+import (
+	"kv/internal/sstable"
+)
+
+/*
+PerfContext counts the work done by reads, so that a slow read can be explained: whether
+the memtable answered it, how many tables were searched and how many blocks were read from
+disk for it. Counters are only ever added to, so a PerfContext may sum up several reads.
+It must not be shared by concurrent reads.
+*/
+type PerfContext struct {
+	// the keys found or deleted in the memtable, without searching any table
+	MemtableHits uint64
+	// the tables searched for a key, newest first till one holds or deletes it
+	TablesSearched uint64
+	// the bloom filters checked, and the lookups they ruled out without reading a block
+	BloomChecks uint64
+	BloomMisses uint64
+	BlocksRead  uint64
+	// the bytes of data blocks read from disk, and the bytes they decompressed into
+	BytesRead         uint64
+	BytesDecompressed uint64
+}
+
+func (perf *PerfContext) addTableStats(stats *sstable.Stats) {
+	perf.TablesSearched += stats.Gets
+	perf.BloomChecks += stats.FilterChecks
+	perf.BloomMisses += stats.FilterMisses
+	perf.BlocksRead += stats.BlocksRead
+	perf.BytesRead += stats.BytesRead
+	perf.BytesDecompressed += stats.BytesDecompressed
+}
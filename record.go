@@ -0,0 +1,145 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"kv/internal/memtable"
+)
+
+/*
+The WAL payloads of the DB. Each payload starts with a kind byte, followed by the encoding
+of the mutation. Lengths are uvarints.
+
+A batch record layout:
+| kind | count | entry | entry | ... |
+| 1B   | ...   |  ...  |  ...  | ... |
+
+An entry layout, val_len and val are absent for deletes:
+| op | key_len | key | val_len | val |
+| 1B |   ...   | ... |   ...   | ... |
+
+A range delete record layout:
+| kind | start_len | start | end_len | end |
+| 1B   |    ...    |  ...  |   ...   | ... |
+*/
+
+type recordKind byte
+
+const (
+	recordBatch recordKind = iota + 1
+	recordRangeDelete
+)
+
+const (
+	opDelete byte = iota
+	opPut
+)
+
+func appendString(buf []byte, str string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(str)))
+	return append(buf, str...)
+}
+
+func encodeBatch(kvs []memtable.KV) []byte {
+	buf := []byte{byte(recordBatch)}
+	buf = binary.AppendUvarint(buf, uint64(len(kvs)))
+	for _, kv := range kvs {
+		if kv.Val == nil {
+			buf = append(buf, opDelete)
+			buf = appendString(buf, kv.Key)
+			continue
+		}
+		buf = append(buf, opPut)
+		buf = appendString(buf, kv.Key)
+		buf = appendString(buf, string(kv.Val))
+	}
+	return buf
+}
+
+func encodeRangeDelete(start, end string) []byte {
+	buf := []byte{byte(recordRangeDelete)}
+	buf = appendString(buf, start)
+	return appendString(buf, end)
+}
+
+// a cursor over a payload, the first decoding error sticks
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.buf)
+	if size <= 0 {
+		r.err = fmt.Errorf("%w: bad length", ErrCorrupt)
+		return 0
+	}
+	r.buf = r.buf[size:]
+	return n
+}
+
+func (r *recordReader) byte_() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) == 0 {
+		r.err = fmt.Errorf("%w: unexpected end of record", ErrCorrupt)
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *recordReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = fmt.Errorf("%w: unexpected end of record", ErrCorrupt)
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// Decode a WAL payload and apply the mutation it holds to the memtable.
+func applyRecord(mt *memtable.Memtable, payload []byte) error {
+	r := &recordReader{buf: payload}
+	switch kind := recordKind(r.byte_()); kind {
+	case recordBatch:
+		count := r.uvarint()
+		kvs := []memtable.KV{}
+		for i := uint64(0); i < count && r.err == nil; i++ {
+			op := r.byte_()
+			kv := memtable.KV{Key: string(r.bytes())}
+			if op == opPut {
+				kv.Val = r.bytes()
+			} else if op != opDelete {
+				r.err = fmt.Errorf("%w: unknown op %d", ErrCorrupt, op)
+			}
+			kvs = append(kvs, kv)
+		}
+		if r.err != nil {
+			return r.err
+		}
+		mt.UpdateBatch(kvs)
+	case recordRangeDelete:
+		start, end := string(r.bytes()), string(r.bytes())
+		if r.err != nil {
+			return r.err
+		}
+		mt.DeleteRange(start, end)
+	default:
+		if r.err != nil {
+			return r.err
+		}
+		return fmt.Errorf("%w: unknown record kind %d", ErrCorrupt, kind)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"kv/internal/memtable"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	mt := memtable.NewMemtable(memtable.DefaultSkipListThreshold, memtable.DefaultSkipListHeight, 1)
+	batch := NewWriteBatch()
+	batch.Put("a", []byte("1"))
+	batch.Put("empty", nil)
+	batch.Put("deleted", []byte("val"))
+	batch.Delete("deleted")
+	assert.NoError(t, applyRecord(mt, encodeBatch(batch.kvs)))
+	assert.NoError(t, applyRecord(mt, encodeRangeDelete("b", "c")))
+
+	val, ok := mt.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(val))
+	val, ok = mt.Get("empty")
+	assert.True(t, ok)
+	assert.NotNil(t, val)
+	assert.Empty(t, val)
+	_, ok = mt.Get("deleted")
+	assert.False(t, ok)
+
+	mt.Update("bb", []byte("val"))
+	assert.NoError(t, applyRecord(mt, encodeRangeDelete("b", "c")))
+	_, ok = mt.Get("bb")
+	assert.False(t, ok)
+}
+
+func TestRecordCorrupt(t *testing.T) {
+	mt := memtable.NewMemtable(memtable.DefaultSkipListThreshold, memtable.DefaultSkipListHeight, 1)
+	batch := NewWriteBatch()
+	batch.Put("key", []byte("val"))
+	encoded := encodeBatch(batch.kvs)
+	for _, payload := range [][]byte{
+		nil,
+		{42},
+		encoded[:len(encoded)-1],
+		encodeRangeDelete("a", "b")[:3],
+	} {
+		assert.ErrorIs(t, applyRecord(mt, payload), ErrCorrupt)
+	}
+	_, ok := mt.Get("key")
+	assert.False(t, ok)
+}
@@ -0,0 +1,421 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"kv/internal/compaction"
+	"kv/internal/memtable"
+	"kv/internal/sstable"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Frozen skiplists are flushed to table files in L0, which compaction merges down into the
+levels below, see package compaction. Tables are named by an increasing number, and the
+MANIFEST records which level every table belongs to. The tables sit behind the memtable on
+the read path, L0 is consulted newest first and then one table of every other level.
+*/
+
+const (
+	tableSuffix = ".sst"
+	// left behind by a flush cut short
+	tmpSuffix = ".tmp"
+	// the number of frozen skiplists beyond which writers flush them instead of the background
+	maxFrozenSkiplists = 4
+)
+
+func tableName(num uint64) string {
+	return fmt.Sprintf("%06d%s", num, tableSuffix)
+}
+
+// an open table file of a level
+type table struct {
+	reader *sstable.Reader
+	meta   compaction.Table
+}
+
+func newTable(num uint64, reader *sstable.Reader) *table {
+	props := reader.Properties()
+	meta := compaction.Table{Num: num, Size: reader.Size(), Smallest: props.MinKey, Largest: props.MaxKey}
+	for i, t := range reader.RangeTombstones() {
+		if (props.Entries == 0 && i == 0) || t.Start < meta.Smallest {
+			meta.Smallest = t.Start
+		}
+		if (props.Entries == 0 && i == 0) || t.End > meta.Largest {
+			meta.Largest = t.End
+		}
+	}
+	return &table{reader: reader, meta: meta}
+}
+
+func openTable(dir string, num uint64) (*table, error) {
+	reader, err := sstable.Open(filepath.Join(dir, tableName(num)))
+	if err != nil {
+		return nil, corruptErr(err)
+	}
+	return newTable(num, reader), nil
+}
+
+/*
+Open the tables of all levels in dir and return the number of the next table. Leftovers of
+flushes and compactions cut short by a crash are removed. Without a MANIFEST, as left by a
+DB from before levels, all tables are taken to be L0 and ordered by their numbers.
+*/
+func openLevels(dir string, numLevels int) ([][]*table, uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	nums := []uint64{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		var num uint64
+		if _, err := fmt.Sscanf(name, "%d"+tableSuffix, &num); err != nil || name != tableName(num) {
+			continue
+		}
+		nums = append(nums, num)
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if m == nil {
+		sort.Slice(nums, func(i, j int) bool { return nums[i] > nums[j] })
+		m = &manifest{next: 1, levels: [][]uint64{nums}}
+		if len(nums) > 0 {
+			m.next = nums[0] + 1
+		}
+	}
+	listed := map[uint64]bool{}
+	for _, level := range m.levels {
+		for _, num := range level {
+			listed[num] = true
+		}
+	}
+	for _, num := range nums {
+		if !listed[num] {
+			if err := os.Remove(filepath.Join(dir, tableName(num))); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	// levels beyond numLevels are kept if NumLevels has been lowered
+	levels := make([][]*table, max(numLevels, len(m.levels)))
+	for i, level := range m.levels {
+		for _, num := range level {
+			t, err := openTable(dir, num)
+			if err != nil {
+				closeLevels(levels)
+				return nil, 0, err
+			}
+			levels[i] = append(levels[i], t)
+		}
+	}
+	return levels, m.next, nil
+}
+
+func closeLevels(levels [][]*table) error {
+	var err error
+	for _, level := range levels {
+		for _, t := range level {
+			if closeErr := t.reader.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func levelsManifest(levels [][]*table, next uint64) *manifest {
+	m := &manifest{next: next, levels: make([][]uint64, len(levels))}
+	for i, level := range levels {
+		for _, t := range level {
+			m.levels[i] = append(m.levels[i], t.meta.Num)
+		}
+	}
+	return m
+}
+
+// surface corruption of internal packages as ErrCorrupt
+func corruptErr(err error) error {
+	if errors.Is(err, sstable.ErrCorrupt) || errors.Is(err, sstable.ErrNotTable) {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return err
+}
+
+// hand out the number of a new table
+func (db *DB) newTableNum() uint64 {
+	db.versionMutex.Lock()
+	defer db.versionMutex.Unlock()
+
+	num := db.nextTable
+	db.nextTable++
+	return num
+}
+
+// a change to the levels
+type versionEdit struct {
+	// the numbers of the tables dropped from any level
+	removed map[uint64]bool
+	// the tables added to level, in any order. L0 tables are added in place of the newest L0
+	// table removed, or as the newest ones
+	level int
+	added []*table
+}
+
+/*
+Apply the edit: make the new levels durable in the MANIFEST, then publish them to readers.
+The tables dropped are closed and removed afterwards, a table left behind is removed by the
+next Open. On error the levels stay as they were.
+*/
+func (db *DB) applyEdit(edit versionEdit) error {
+	db.versionMutex.Lock()
+	defer db.versionMutex.Unlock()
+
+	levels := make([][]*table, len(db.levels))
+	removed := []*table{}
+	// where the tables added to L0 go
+	at := 0
+	for i, level := range db.levels {
+		for _, t := range level {
+			if !edit.removed[t.meta.Num] {
+				levels[i] = append(levels[i], t)
+				continue
+			}
+			if i == 0 && len(removed) == 0 {
+				at = len(levels[0])
+			}
+			removed = append(removed, t)
+		}
+	}
+	if edit.level == 0 {
+		levels[0] = append(levels[0][:at], append(append([]*table{}, edit.added...), levels[0][at:]...)...)
+	} else {
+		levels[edit.level] = append(levels[edit.level], edit.added...)
+		sort.Slice(levels[edit.level], func(i, j int) bool {
+			return levels[edit.level][i].meta.Smallest < levels[edit.level][j].meta.Smallest
+		})
+	}
+	if err := writeManifest(filepath.Join(db.path, db.opts.TableSubdir), levelsManifest(levels, db.nextTable)); err != nil {
+		return err
+	}
+
+	// lookups hold the read lock throughout, so no one reads the dropped tables past this
+	db.tablesMutex.Lock()
+	db.levels = levels
+	db.tablesMutex.Unlock()
+	for _, t := range removed {
+		t.reader.Close()
+		os.Remove(t.reader.Path())
+	}
+	return nil
+}
+
+/*
+TableProperties describes a table file: its level, its key range, how many KV pairs and
+tombstones it holds and how large its data blocks are. Tables written before properties
+were recorded leave Tombstones and RawDataSize zero.
+*/
+type TableProperties struct {
+	// the file name of the table in the table directory
+	Name  string
+	Level int
+	sstable.Properties
+}
+
+// the properties of all tables, L0 newest first, then every other level in key order
+func (db *DB) TableProperties() ([]TableProperties, error) {
+	db.rwMutex.RLock()
+	defer db.rwMutex.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+
+	props := []TableProperties{}
+	for i, level := range db.levels {
+		for _, t := range level {
+			props = append(props, TableProperties{
+				Name:       filepath.Base(t.reader.Path()),
+				Level:      i,
+				Properties: t.reader.Properties(),
+			})
+		}
+	}
+	return props, nil
+}
+
+/*
+Look the key up in the tables after the memtable had nothing to say about it. Report whether
+the key was found, with a nil val if it is deleted.
+*/
+func (db *DB) lookupTables(key string, ro *ReadOptions) ([]byte, bool, error) {
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+
+	tro := &sstable.ReadOptions{SkipChecksums: ro.skipChecksums()}
+	if perf := ro.perf(); perf != nil {
+		tro.Stats = &sstable.Stats{}
+		defer perf.addTableStats(tro.Stats)
+	}
+	for i, level := range db.levels {
+		tables := level
+		if i > 0 {
+			// only the last table starting at or before the key may hold it
+			j := sort.Search(len(level), func(j int) bool { return level[j].meta.Smallest > key })
+			if j == 0 {
+				continue
+			}
+			tables = level[j-1 : j]
+		}
+		for _, t := range tables {
+			val, found, err := t.reader.Get(key, tro)
+			if err != nil {
+				return nil, false, corruptErr(err)
+			}
+			if found {
+				return val, true, nil
+			}
+			// the keys of a table are newer than its range tombstones
+			if t.reader.RangeDeleted(key) {
+				return nil, true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+func (db *DB) lookup(key string, ro *ReadOptions) ([]byte, bool, error) {
+	if val, found := db.mt.Lookup(key); found {
+		if perf := ro.perf(); perf != nil {
+			perf.MemtableHits++
+		}
+		return val, val != nil, nil
+	}
+	val, found, err := db.lookupTables(key, ro)
+	return val, found && val != nil, err
+}
+
+/*
+Make sure the next write lands in a mutable skiplist with room for it. Whenever the
+memtable freezes, the WAL is rolled over, so every skiplist starts a segment of its own
+and the segments of a flushed skiplist can be removed. Frozen skiplists are flushed in the
+background, unless more than maxFrozenSkiplists pile up, then the writer flushes them
+itself. The caller must hold writeMutex.
+*/
+func (db *DB) makeRoom(rangeDelete bool) error {
+	if db.mt.WillFreeze(rangeDelete) {
+		if err := db.freeze(); err != nil {
+			return err
+		}
+	}
+	if db.mt.Len()-1 > maxFrozenSkiplists {
+		return db.flushFrozen()
+	}
+	return nil
+}
+
+// Freeze the memtable on a new WAL segment. The caller must hold writeMutex.
+func (db *DB) freeze() error {
+	if err := db.wal.Rotate(); err != nil {
+		return err
+	}
+	db.mt.Freeze()
+	db.walStarts = append([]uint64{db.wal.Seq()}, db.walStarts...)
+	db.scheduleJobs()
+	return nil
+}
+
+// Flush all frozen skiplists and remove their WAL segments. The caller must hold writeMutex.
+func (db *DB) flushFrozen() error {
+	db.flushMutex.Lock()
+	err := db.flushSkiplists()
+	db.flushMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return db.removeFlushedWAL()
+}
+
+func (db *DB) flushInBackground() error {
+	db.flushMutex.Lock()
+	err := db.flushSkiplists()
+	db.flushMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	return db.removeFlushedWAL()
+}
+
+/*
+Flush all frozen skiplists to L0 tables, oldest first. A table is published before its
+skiplist is dropped, so readers find the keys in one or the other all the time. The caller
+must hold flushMutex.
+*/
+func (db *DB) flushSkiplists() error {
+	tableDir := filepath.Join(db.path, db.opts.TableSubdir)
+	for {
+		flushed, err := db.mt.FlushLast(func(it *memtable.MemtableIterator) error {
+			num := db.newTableNum()
+			if err := sstable.WriteSkiplist(filepath.Join(tableDir, tableName(num)), it, db.opts.tableOptions()); err != nil {
+				return err
+			}
+			return db.addL0(tableDir, num)
+		})
+		if err != nil || !flushed {
+			return err
+		}
+	}
+}
+
+/*
+Remove the WAL segments of the skiplists flushed so far: the segments before the start of
+the oldest skiplist left only held flushed ones. The caller must hold writeMutex, so that
+no skiplist is frozen meanwhile.
+*/
+func (db *DB) removeFlushedWAL() error {
+	if len(db.walStarts) <= db.mt.Len() {
+		return nil
+	}
+	db.walStarts = db.walStarts[:db.mt.Len()]
+	return db.wal.RemoveBefore(db.walStarts[len(db.walStarts)-1])
+}
+
+/*
+Add the table file num in dir to L0 as the newest table, the file is removed on error. The
+caller must hold flushMutex.
+*/
+func (db *DB) addL0(dir string, num uint64) error {
+	t, err := openTable(dir, num)
+	if err != nil {
+		os.Remove(filepath.Join(dir, tableName(num)))
+		return err
+	}
+	if err := db.applyEdit(versionEdit{added: []*table{t}}); err != nil {
+		t.reader.Close()
+		os.Remove(filepath.Join(dir, tableName(num)))
+		return err
+	}
+	if db.opts.DeterministicCompaction {
+		return db.compactAll()
+	}
+	db.scheduleJobs()
+	return nil
+}
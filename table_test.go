@@ -0,0 +1,220 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// wait till the background jobs are done, a job about to finish schedules the next one
+func waitForJobs(t *testing.T, db *DB) {
+	assert.Eventually(t, func() bool {
+		db.jobsMutex.Lock()
+		defer db.jobsMutex.Unlock()
+		return db.jobs == 0
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestFlushToTables(t *testing.T) {
+	path := t.TempDir()
+	// each KV pair takes 32 bytes, so a skiplist is frozen every 4 pairs
+	opts := &Options{MemtableThreshold: 128, L0CompactionTrigger: 100}
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%02d", i), make([]byte, 26), nil))
+	}
+	// overwrite and delete keys that have been flushed already
+	assert.NoError(t, db.Put("key-00", []byte("new"), nil))
+	assert.NoError(t, db.Delete("key-01", nil))
+	assert.NoError(t, db.DeleteRange("key-10", "key-20", nil))
+	waitForJobs(t, db)
+
+	tables := listDir(t, filepath.Join(path, defaultTableSubdir))
+	assert.Greater(t, len(tables), 5)
+	// only the segments of skiplists not flushed yet are kept
+	assert.Less(t, len(listDir(t, filepath.Join(path, defaultWALSubdir))), 4)
+
+	check := func(db *DB) {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key-%02d", i)
+			val, err := db.Get(key, nil)
+			switch {
+			case i == 0:
+				assert.NoError(t, err)
+				assert.Equal(t, "new", string(val))
+			case i == 1 || (10 <= i && i < 20):
+				assert.ErrorIs(t, err, ErrNotFound, key)
+			default:
+				assert.NoError(t, err, key)
+				assert.Equal(t, make([]byte, 26), val)
+			}
+		}
+		vals, errs := db.MultiGet([]string{"key-00", "key-01", "key-15", "key-30", "absent"}, nil)
+		assert.Equal(t, "new", string(vals[0]))
+		assert.NoError(t, errs[0])
+		assert.ErrorIs(t, errs[1], ErrNotFound)
+		assert.ErrorIs(t, errs[2], ErrNotFound)
+		assert.NoError(t, errs[3])
+		assert.ErrorIs(t, errs[4], ErrNotFound)
+		ok, err := db.Has("key-15", nil)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+	check(db)
+	assert.NoError(t, db.Close())
+
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	check(db)
+	// keys revived over a range tombstone in a table
+	assert.NoError(t, db.Put("key-15", []byte("back"), nil))
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("more-%02d", i), make([]byte, 26), nil))
+	}
+	val, err := db.Get("key-15", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "back", string(val))
+	assert.NoError(t, db.Close())
+}
+
+func TestOpenRemovesPartialTables(t *testing.T) {
+	path := t.TempDir()
+	db, err := Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	tableDir := filepath.Join(path, defaultTableSubdir)
+	assert.NoError(t, os.WriteFile(filepath.Join(tableDir, tableName(1)+tmpSuffix), []byte("partial"), 0644))
+	db, err = Open(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+	assert.Equal(t, []string{manifestName}, listDir(t, tableDir))
+
+	// tables the MANIFEST does not list are left from compactions cut short
+	assert.NoError(t, os.WriteFile(filepath.Join(tableDir, tableName(1)), []byte("orphan"), 0644))
+	db, err = Open(path, &Options{MemtableThreshold: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{manifestName}, listDir(t, tableDir))
+	assert.NoError(t, db.Put("key", []byte("val"), nil))
+	assert.NoError(t, db.Put("flush", []byte("x"), nil))
+	assert.NoError(t, db.Close())
+
+	// a table that cannot be read keeps the DB from opening
+	assert.NoError(t, os.WriteFile(filepath.Join(tableDir, tableName(1)), []byte("garbage"), 0644))
+	_, err = Open(path, nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestPerfContext(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemtableThreshold: 128, L0CompactionTrigger: 100})
+	assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 40; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%02d", i), make([]byte, 26), nil))
+	}
+	waitForJobs(t, db)
+
+	perf := &PerfContext{}
+	_, err = db.Get("key-39", &ReadOptions{Perf: perf})
+	assert.NoError(t, err)
+	assert.Equal(t, PerfContext{MemtableHits: 1}, *perf)
+
+	// the oldest table holds the key, every newer one is searched before
+	perf = &PerfContext{}
+	_, err = db.Get("key-00", &ReadOptions{Perf: perf})
+	assert.NoError(t, err)
+	assert.Zero(t, perf.MemtableHits)
+	assert.Equal(t, uint64(len(db.levels[0])), perf.TablesSearched)
+	assert.Equal(t, perf.TablesSearched, perf.BloomChecks)
+	// key-00 sorts before the blocks of newer tables, so only the block holding it is read
+	assert.Equal(t, uint64(1), perf.BlocksRead)
+	assert.Greater(t, perf.BytesRead, uint64(0))
+
+	// counters add up over several reads
+	perf = &PerfContext{}
+	_, errs := db.MultiGet([]string{"key-39", "key-00", "absent"}, &ReadOptions{Perf: perf})
+	assert.ErrorIs(t, errs[2], ErrNotFound)
+	assert.Equal(t, uint64(1), perf.MemtableHits)
+	assert.Equal(t, uint64(2*len(db.levels[0])), perf.TablesSearched)
+}
+
+func TestTableChecksums(t *testing.T) {
+	path := t.TempDir()
+	opts := &Options{MemtableThreshold: 1}
+	db, err := Open(path, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Put("key", []byte("val"), nil))
+	assert.NoError(t, db.Put("flush", []byte("x"), nil))
+	assert.NoError(t, db.Close())
+
+	tablePath := filepath.Join(path, defaultTableSubdir, tableName(1))
+	data, err := os.ReadFile(tablePath)
+	assert.NoError(t, err)
+	i := bytes.Index(data, []byte("keyval"))
+	assert.GreaterOrEqual(t, i, 0)
+	data[i+len("keyva")] = 'x'
+	assert.NoError(t, os.WriteFile(tablePath, data, 0644))
+
+	db, err = Open(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get("key", nil)
+	assert.ErrorIs(t, err, ErrCorrupt)
+	val, err := db.Get("key", &ReadOptions{SkipChecksums: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "vax", string(val))
+}
+
+func TestTableProperties(t *testing.T) {
+	db, err := Open(t.TempDir(), &Options{MemtableThreshold: 128})
+	assert.NoError(t, err)
+	defer db.Close()
+	props, err := db.TableProperties()
+	assert.NoError(t, err)
+	assert.Empty(t, props)
+
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, db.Put(fmt.Sprintf("key-%02d", i), make([]byte, 26), nil))
+	}
+	assert.NoError(t, db.Delete("key-08", nil))
+	// the range tombstone freezes the skiplist holding the tombstone
+	assert.NoError(t, db.DeleteRange("a", "b", nil))
+	waitForJobs(t, db)
+
+	props, err = db.TableProperties()
+	assert.NoError(t, err)
+	assert.Len(t, props, 3)
+	// newest first
+	assert.Equal(t, tableName(3), props[0].Name)
+	assert.Equal(t, "key-08", props[0].MinKey)
+	assert.Equal(t, "key-08", props[0].MaxKey)
+	assert.Equal(t, uint64(1), props[0].Entries)
+	assert.Equal(t, uint64(1), props[0].Tombstones)
+	for i, minKey := range []string{"key-04", "key-00"} {
+		assert.Equal(t, minKey, props[i+1].MinKey)
+		assert.Equal(t, uint64(4), props[i+1].Entries)
+		assert.Zero(t, props[i+1].Tombstones)
+		assert.Greater(t, props[i+1].DataSize, uint64(4*26))
+	}
+	assert.Equal(t, "key-07", props[1].MaxKey)
+
+	assert.NoError(t, db.Close())
+	_, err = db.TableProperties()
+	assert.ErrorIs(t, err, ErrClosed)
+}